@@ -200,6 +200,10 @@ func (e *Editor) Events(delta float64, fadeDir int, mouseX, mouseY, mouseWorldX,
 	if e.app.IsFirstDown(glfw.KeyF) {
 		e.fill()
 	}
+	if e.app.IsFirstDown(glfw.KeyR) {
+		e.ReEdge(e.app.Loader.X-gfx.DRAW_SIZE/2, e.app.Loader.Y-gfx.DRAW_SIZE/2, gfx.DRAW_SIZE, gfx.DRAW_SIZE)
+		changed = true
+	}
 
 	// call bscript
 	e.editorCall.Evaluate(e.ctx)
@@ -347,6 +351,37 @@ func (e *Editor) setEdges(x, y int, shape *shapes.Shape) {
 		edgeName = "w"
 	}
 
+	if edgeShape == nil || edgeShape.IsBlobTiling(shape.Name) {
+		corners := []struct {
+			name   string
+			dx, dy int
+			a, b   *shapes.Shape
+		}{
+			{"ne", -w, -h, shapeN, shapeE},
+			{"nw", w, -h, shapeN, shapeW},
+			{"se", -w, h, shapeS, shapeE},
+			{"sw", w, h, shapeS, shapeW},
+		}
+		for _, corner := range corners {
+			if corner.a != nil || corner.b != nil {
+				continue
+			}
+			cornerShape := e.getEdgeShape(x+corner.dx, y+corner.dy, shape)
+			if cornerShape == nil || cornerShape.Index == shape.Index || cornerShape.IsBlobTiling(shape.Name) == false {
+				continue
+			}
+			if edgeShape == nil {
+				edgeShape = cornerShape
+			} else if edgeShape.Index != cornerShape.Index {
+				continue
+			}
+			if edgeName != "" {
+				edgeName += "_"
+			}
+			edgeName += "c" + corner.name
+		}
+	}
+
 	if edgeName != "" && edgeShape.Index != shape.Index {
 		edge := edgeShape.GetEdge(shape.Name, edgeName)
 		if edge != nil {
@@ -355,6 +390,28 @@ func (e *Editor) setEdges(x, y int, shape *shapes.Shape) {
 	}
 }
 
+// ReEdge recomputes the ground edges of every shape in the given area
+func (e *Editor) ReEdge(x, y, w, h int) {
+	seen := map[string]bool{}
+	for xx := x; xx < x+w; xx++ {
+		for yy := y; yy < y+h; yy++ {
+			if e.app.View.InView(xx, yy, 0) == false {
+				continue
+			}
+			shapeIndex, ox, oy, _, found := e.app.View.GetShape(xx, yy, 0)
+			if found == false {
+				continue
+			}
+			key := fmt.Sprintf("%d.%d", ox, oy)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = true
+			e.setEdges(ox, oy, shapes.Shapes[shapeIndex])
+		}
+	}
+}
+
 func (e *Editor) getEdgeShape(x, y int, target *shapes.Shape) *shapes.Shape {
 	shapeIndex, _, _, _, found := e.app.View.GetShape(x, y, 0)
 	if found == false {
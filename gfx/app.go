@@ -59,6 +59,10 @@ type AppConfig struct {
 	shear      [3]float32
 	shapes     []map[string]interface{}
 	creatures  []map[string]interface{}
+	variants   []map[string]interface{}
+	weather    map[string]interface{}
+	post       []map[string]interface{}
+	shaders    map[string]interface{}
 }
 
 type App struct {
@@ -98,9 +102,17 @@ type App struct {
 	cursorPanel                          *Panel
 	Loading                              bool
 	Cursors                              map[string]*glfw.Cursor
+	capture                              Capture
+	Post                                 *PostChain
+	started                              bool
+	window                               WindowState
 }
 
 func NewApp(game Game, gameDir string, windowWidth, windowHeight int, targetFps float64) *App {
+	return newApp(game, gameDir, windowWidth, windowHeight, targetFps, false)
+}
+
+func newApp(game Game, gameDir string, windowWidth, windowHeight int, targetFps float64, headless bool) *App {
 	// make sure the ./game/maps dir exists
 	mapDir := filepath.Join(gameDir, "maps")
 	if _, err := os.Stat(mapDir); os.IsNotExist(err) {
@@ -108,6 +120,9 @@ func NewApp(game Game, gameDir string, windowWidth, windowHeight int, targetFps
 	}
 	appConfig := parseConfig(gameDir)
 	width, height := getResolution(appConfig, game.Name())
+	if headless {
+		windowWidth, windowHeight = width, height
+	}
 	app := &App{
 		Game:         game,
 		Config:       appConfig,
@@ -132,14 +147,15 @@ func NewApp(game Game, gameDir string, windowWidth, windowHeight int, targetFps
 	}()
 
 	app.addFonts(appConfig, gameDir, game.Name())
-	app.Dir = initUserdir(appConfig.Name)
-	app.Window = initWindow(windowWidth, windowHeight)
-	app.pxWidth, app.pxHeight = app.Window.GetFramebufferSize()
-	app.dpiX = float32(app.pxWidth) / float32(windowWidth)
-	app.dpiY = float32(app.pxHeight) / float32(windowHeight)
-	fmt.Printf("Resolution: %dx%d Window: %dx%d Dpi: %fx%f\n", app.Width, app.Height, windowWidth, windowHeight, app.dpiX, app.dpiY)
-	app.windowWidthDpi = int(float32(app.windowWidth) * app.dpiX)
-	app.windowHeightDpi = int(float32(app.windowHeight) * app.dpiY)
+	if headless {
+		app.Dir = initTempdir(appConfig.Name)
+		app.fade = 1
+	} else {
+		app.Dir = initUserdir(appConfig.Name)
+	}
+	app.Window = initWindow(windowWidth, windowHeight, !headless)
+	app.initWindowState()
+	fmt.Printf("Resolution: %dx%d Window: %dx%d Dpi: %fx%f\n", app.Width, app.Height, app.windowWidth, app.windowHeight, app.dpiX, app.dpiY)
 	app.Window.SetKeyCallback(app.Keypressed)
 	app.Window.SetScrollCallback(app.MouseScroll)
 	app.Window.SetCursorPosCallback(app.MousePos)
@@ -147,6 +163,7 @@ func NewApp(game Game, gameDir string, windowWidth, windowHeight int, targetFps
 	app.Window.SetCloseCallback(app.AppExit)
 	app.frameBuffer = NewFrameBuffer(int32(width), int32(height), true)
 	app.uiFrameBuffer = NewFrameBuffer(int32(width), int32(height), false)
+	app.Post = NewPostChain(appConfig.post, width, height)
 	err := shapes.InitShapes(gameDir, appConfig.shapes)
 	if err != nil {
 		panic(err)
@@ -156,8 +173,14 @@ func NewApp(game Game, gameDir string, windowWidth, windowHeight int, targetFps
 	if err != nil {
 		panic(err)
 	}
+	err = shapes.InitVariants(appConfig.variants)
+	if err != nil {
+		panic(err)
+	}
 	app.Loader = world.NewLoader(game.(world.WorldObserver), app.Dir, gameDir)
 	app.View = InitView(appConfig.zoom, appConfig.camera, appConfig.shear, app.Loader)
+	app.View.Weather = NewWeather(appConfig.weather)
+	app.View.AddShaders(appConfig.shaders)
 	app.Ui = InitUi(width, height)
 	return app
 }
@@ -219,6 +242,18 @@ func parseConfig(gameDir string) *AppConfig {
 		shapes:     toMap(data["shapes"].([]interface{})),
 		creatures:  toMap(data["creatures"].([]interface{})),
 	}
+	if variants, ok := data["variants"].([]interface{}); ok {
+		config.variants = toMap(variants)
+	}
+	if weather, ok := data["weather"].(map[string]interface{}); ok {
+		config.weather = weather
+	}
+	if post, ok := data["postProcess"].([]interface{}); ok {
+		config.post = toMap(post)
+	}
+	if shaders, ok := data["shaders"].(map[string]interface{}); ok {
+		config.shaders = shaders
+	}
 	fmt.Printf("Starting game: %s (v%f)\n", config.Title, config.Version)
 	return config
 }
@@ -295,8 +330,13 @@ func initUserdir(gameName string) string {
 	return dir
 }
 
-func initWindow(windowWidth, windowHeight int) *glfw.Window {
-	glfw.WindowHint(glfw.Resizable, glfw.False)
+func initWindow(windowWidth, windowHeight int, visible bool) *glfw.Window {
+	if visible {
+		glfw.WindowHint(glfw.Resizable, glfw.True)
+	} else {
+		glfw.WindowHint(glfw.Resizable, glfw.False)
+		glfw.WindowHint(glfw.Visible, glfw.False)
+	}
 	glfw.WindowHint(glfw.ContextVersionMajor, 4)
 	glfw.WindowHint(glfw.ContextVersionMinor, 1)
 	glfw.WindowHint(glfw.OpenGLProfile, glfw.OpenGLCoreProfile)
@@ -391,8 +431,9 @@ func (app *App) PanelAtMouse() (*Panel, int, int) {
 func (app *App) MousePos(w *glfw.Window, xpos float64, ypos float64) {
 	app.MouseX = int32(xpos)
 	app.MouseY = int32(ypos)
-	app.MousePixelX = int32(xpos / float64(app.windowWidth) * float64(app.Width))
-	app.MousePixelY = int32(ypos / float64(app.windowHeight) * float64(app.Height))
+	pixelX, pixelY := app.toPixelCoords(app.MouseX, app.MouseY)
+	app.MousePixelX = int32(pixelX)
+	app.MousePixelY = int32(pixelY)
 	if app.cursorPanel != nil {
 		app.Ui.MovePanel(app.cursorPanel, int(app.MousePixelX), int(app.MousePixelY))
 	}
@@ -421,7 +462,8 @@ func (app *App) MousePos(w *glfw.Window, xpos float64, ypos float64) {
 }
 
 func (app *App) toPixelCoords(windowX, windowY int32) (int, int) {
-	return int(float32(windowX) * float32(app.Width) / float32(app.windowWidth)), int(float32(windowY) * float32(app.Height) / float32(app.windowHeight))
+	x, y, w, h := app.windowViewport()
+	return int((float32(windowX) - x) * float32(app.Width) / w), int((float32(windowY) - y) * float32(app.Height) / h)
 }
 
 func (app *App) MouseClick(w *glfw.Window, button glfw.MouseButton, action glfw.Action, mods glfw.ModifierKey) {
@@ -496,13 +538,17 @@ func (app *App) Sleep(lastTime float64) (float64, float64) {
 	return now, d
 }
 
-func (app *App) Run() {
+func (app *App) init() {
 	app.Game.Init(app, app.Config.runtime[app.Game.Name()].(map[string]interface{}))
 
 	// Configure global settings
 	gl.Enable(gl.DEPTH_TEST)
 	gl.DepthFunc(gl.LESS)
 	// gl.ClearColor(0, 0, 0, 0)
+}
+
+func (app *App) Run() {
+	app.init()
 
 	last := glfw.GetTime()
 	var delta float64
@@ -517,11 +563,12 @@ func (app *App) Run() {
 		app.CalcFps()
 
 		app.incrFade(last)
+		app.clearWindow()
 
 		// mouse click selection
 		app.frameBuffer.Enable(app.Width, app.Height)
 		app.View.Draw(delta, true)
-		app.frameBuffer.Draw(app.windowWidthDpi, app.windowHeightDpi, app.fade)
+		app.frameBuffer.Draw(app.window.viewport, app.fade)
 		mouseVector[0] = float32(app.MouseX)
 		mouseVector[1] = float32(app.MouseY)
 		if app.readSelection == readDragPos {
@@ -543,29 +590,31 @@ func (app *App) Run() {
 
 		// click/move: use exact mouse location
 		blockPos := app.View.getShapeExact(vx, vy, vz)
-		if blockPos != nil && (blockPos.pos == nil || blockPos.pos.Block == 0) {
+		if blockPos != nil && (blockPos.Pos == nil || blockPos.Pos.Block == 0) {
 			blockPos = nil
 		}
 		if blockPos != nil {
-			shape := shapes.Shapes[blockPos.pos.Block-1]
+			shape := shapes.Shapes[blockPos.Pos.Block-1]
 			if shape.IsDraggable || shape.IsInteractive {
-				wx = blockPos.worldX
-				wy = blockPos.worldY
-				wz = blockPos.worldZ
+				wx = blockPos.WorldX
+				wy = blockPos.WorldY
+				wz = blockPos.WorldZ
 			} else {
 				blockPos = nil
 			}
 		}
-		wx, wy, wz = app.View.toWorldPos(vx, vy, vz)
+		wx, wy, wz = app.View.ToWorldPos(vx, vy, vz)
 
 		if app.readSelection != dontReadPos {
 			if app.readSelection == readMousePos && app.Dragging {
 				// drag drop: find closest position to mouse
-				if wx, wy, wz, ok := app.View.GetClosestSurfacePoint(mouseVector, vx, vy, vz, app.windowWidth, app.windowHeight); ok {
+				x, y, w, h := app.windowViewport()
+				viewMouse := mgl32.Vec2{mouseVector[0] - x, mouseVector[1] - y}
+				if wx, wy, wz, ok := app.View.GetClosestSurfacePoint(viewMouse, vx, vy, vz, int(w), int(h)); ok {
 					app.View.SetClick(wx, wy, wz)
 				}
 			} else {
-				if app.Dragging && (blockPos == nil || !shapes.Shapes[blockPos.pos.Block-1].IsDraggable) {
+				if app.Dragging && (blockPos == nil || !shapes.Shapes[blockPos.Pos.Block-1].IsDraggable) {
 					app.Dragging = false
 				} else {
 					app.View.SetClick(wx, wy, wz)
@@ -579,11 +628,16 @@ func (app *App) Run() {
 
 		app.frameBuffer.Enable(app.Width, app.Height)
 		app.View.Draw(delta, false)
-		app.frameBuffer.Draw(app.windowWidthDpi, app.windowHeightDpi, app.fade)
+		scene := app.Post.Apply(app.frameBuffer.texture, delta)
+		app.frameBuffer.DrawTexture(scene, app.window.viewport, app.fade)
 
 		app.uiFrameBuffer.Enable(app.Width, app.Height)
 		app.Ui.Draw()
-		app.uiFrameBuffer.Draw(app.windowWidthDpi, app.windowHeightDpi, app.fade)
+		app.uiFrameBuffer.Draw(app.window.viewport, app.fade)
+
+		app.captureKeys()
+		app.captureFrame()
+		app.windowKeys()
 
 		// Maintenance
 		app.Window.SwapBuffers()
@@ -690,5 +744,6 @@ func fixArrays(data interface{}) {
 
 func (app *App) AppExit(w *glfw.Window) {
 	fmt.Println("* AppExit callback")
+	app.StopCapture()
 	app.Game.Exit()
 }
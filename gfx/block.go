@@ -12,6 +12,8 @@ type Block struct {
 	shape               *shapes.Shape
 	texture             *Texture
 	index               int32
+	// drawn with this shader if not nil
+	custom *CustomShader
 }
 
 func (view *View) initBlocks() []*Block {
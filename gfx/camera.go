@@ -0,0 +1,243 @@
+package gfx
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/go-gl/gl/all-core/gl"
+	"github.com/uzudil/isongn/spatial"
+)
+
+const (
+	MIN_ZOOM = 0.35
+	MAX_ZOOM = 16
+)
+
+// CameraPoint is a world position on a camera path
+type CameraPoint [3]float32
+
+type cameraPath struct {
+	handle   int
+	points   []CameraPoint
+	speed    float32
+	segment  int
+	progress float32
+}
+
+// Camera moves the view smoothly. While it follows a shape or plays a path it owns the view's position,
+// otherwise the view is positioned by the game (moveViewTo, setViewScroll).
+type Camera struct {
+	// world position of the view center, x, y and the z scroll
+	pos [3]float32
+	// follow the shape at this origin, with the target allowed to move deadZone units from the center
+	following bool
+	target    [3]int
+	deadZone  float32
+	// how quickly the camera catches up (per second), 0 snaps to the target
+	easing float32
+	// scripted movement, for cutscenes
+	path       *cameraPath
+	pathHandle int
+	pathsDone  []int
+	// zoom tween
+	zoomFrom, zoomTo       float64
+	zoomTime, zoomDuration float64
+	// shake
+	shakeAmplitude, shakeDecay float32
+	shake                      [3]float32
+}
+
+func (camera *Camera) isActive() bool {
+	return camera.following || camera.path != nil
+}
+
+// the current view center as a camera position
+func (view *View) cameraPos() [3]float32 {
+	x, y := view.Loader.GetCenter()
+	return [3]float32{float32(x) + view.ScrollOffset[0], float32(y) + view.ScrollOffset[1], view.ScrollOffset[2]}
+}
+
+// CameraFollow keeps the shape at the origin worldX, worldY, worldZ in view, the camera moves when it's
+// further than deadZone from the center. The camera keeps following the shape when it's moved.
+func (view *View) CameraFollow(worldX, worldY, worldZ int, deadZone, easing float32) {
+	camera := &view.Camera
+	if !camera.isActive() {
+		camera.pos = view.cameraPos()
+	}
+	camera.following = true
+	camera.path = nil
+	camera.target = [3]int{worldX, worldY, worldZ}
+	camera.deadZone = deadZone
+	camera.easing = easing
+}
+
+// CameraPath moves the view through the points at speed (units per second) and returns a handle. The
+// handle is reported by TakeCameraPathsDone when the last point is reached. It stops following a shape.
+func (view *View) CameraPath(points []CameraPoint, speed float32) int {
+	camera := &view.Camera
+	camera.pos = view.cameraPos()
+	camera.following = false
+	camera.pathHandle++
+	camera.path = &cameraPath{
+		handle: camera.pathHandle,
+		points: append([]CameraPoint{CameraPoint(camera.pos)}, points...),
+		speed:  speed,
+	}
+	return camera.pathHandle
+}
+
+// CameraStop gives the control of the view back to the game
+func (view *View) CameraStop() {
+	view.Camera.following = false
+	view.Camera.path = nil
+}
+
+// TakeCameraPathsDone returns the handles of the camera paths finished since the last call
+func (view *View) TakeCameraPathsDone() []int {
+	done := view.Camera.pathsDone
+	view.Camera.pathsDone = nil
+	return done
+}
+
+// CameraShake shakes the view by amplitude units, decreasing by decay units per second
+func (view *View) CameraShake(amplitude, decay float32) {
+	view.Camera.shakeAmplitude = amplitude
+	view.Camera.shakeDecay = decay
+}
+
+// ZoomTo changes the zoom to level over seconds
+func (view *View) ZoomTo(level, seconds float64) {
+	camera := &view.Camera
+	camera.zoomFrom = view.zoom
+	camera.zoomTo = level
+	camera.zoomTime = 0
+	camera.zoomDuration = seconds
+	if seconds <= 0 {
+		view.SetZoom(level)
+	}
+}
+
+func (view *View) GetZoom() float64 {
+	return view.zoom
+}
+
+// CellMoved follows the camera's target and the cutaway focus to their new origin
+func (view *View) CellMoved(cell *spatial.Cell, fromX, fromY, fromZ int) {
+	camera := &view.Camera
+	if camera.following && camera.target == [3]int{fromX, fromY, fromZ} {
+		camera.target = [3]int{cell.WorldX, cell.WorldY, cell.WorldZ}
+	}
+	view.cutaway.moved(cell, fromX, fromY, fromZ)
+}
+
+func (view *View) updateCamera(delta float64) {
+	camera := &view.Camera
+	dt := float32(delta)
+
+	if camera.zoomTime < camera.zoomDuration {
+		camera.zoomTime += delta
+		t := math.Min(camera.zoomTime/camera.zoomDuration, 1)
+		view.SetZoom(camera.zoomFrom + (camera.zoomTo-camera.zoomFrom)*smoothstep(t))
+	}
+
+	camera.shake = [3]float32{}
+	if camera.shakeAmplitude > 0 {
+		for i := range camera.shake {
+			camera.shake[i] = (rand.Float32()*2 - 1) * camera.shakeAmplitude
+		}
+		camera.shakeAmplitude -= camera.shakeDecay * dt
+	}
+
+	if camera.following {
+		view.followTarget(dt)
+	} else if camera.path != nil {
+		view.advancePath(dt)
+	} else {
+		return
+	}
+
+	// the view center is at a whole position, the rest is scrolled
+	x := int(math.Floor(float64(camera.pos[0]) + 0.5))
+	y := int(math.Floor(float64(camera.pos[1]) + 0.5))
+	if view.Loader.MoveTo(x, y) {
+		view.Load()
+	}
+	view.ScrollOffset = [3]float32{camera.pos[0] - float32(x), camera.pos[1] - float32(y), camera.pos[2]}
+}
+
+func (view *View) followTarget(dt float32) {
+	camera := &view.Camera
+	// the target includes the shape's offset, so the camera moves with its animation between positions
+	target := [2]float32{float32(camera.target[0]), float32(camera.target[1])}
+	if blockPos := view.GetBlockPos(camera.target[0], camera.target[1], camera.target[2]); blockPos != nil {
+		target[0] += blockPos.ScrollOffset[0]
+		target[1] += blockPos.ScrollOffset[1]
+	}
+	for i := range target {
+		d := target[i] - camera.pos[i]
+		if d > camera.deadZone {
+			target[i] -= camera.deadZone
+		} else if d < -camera.deadZone {
+			target[i] += camera.deadZone
+		} else {
+			target[i] = camera.pos[i]
+		}
+	}
+	t := float32(1)
+	if camera.easing > 0 {
+		t = 1 - float32(math.Exp(float64(-camera.easing*dt)))
+	}
+	camera.pos[0] += (target[0] - camera.pos[0]) * t
+	camera.pos[1] += (target[1] - camera.pos[1]) * t
+}
+
+func (view *View) advancePath(dt float32) {
+	camera := &view.Camera
+	path := camera.path
+	step := path.speed * dt
+	for step > 0 && path.segment < len(path.points)-1 {
+		from := path.points[path.segment]
+		to := path.points[path.segment+1]
+		length := float32(math.Sqrt(float64((to[0]-from[0])*(to[0]-from[0]) + (to[1]-from[1])*(to[1]-from[1]) + (to[2]-from[2])*(to[2]-from[2]))))
+		if length-path.progress > step {
+			path.progress += step
+			step = 0
+			t := path.progress / length
+			for i := range camera.pos {
+				camera.pos[i] = from[i] + (to[i]-from[i])*t
+			}
+		} else {
+			step -= length - path.progress
+			path.progress = 0
+			path.segment++
+			camera.pos = to
+		}
+	}
+	if path.segment >= len(path.points)-1 {
+		camera.pathsDone = append(camera.pathsDone, path.handle)
+		camera.path = nil
+	}
+}
+
+// the view scroll with the camera shake
+func (view *View) viewScroll() [3]float32 {
+	return [3]float32{
+		view.ScrollOffset[0] + view.Camera.shake[0],
+		view.ScrollOffset[1] + view.Camera.shake[1],
+		view.ScrollOffset[2] + view.Camera.shake[2],
+	}
+}
+
+func smoothstep(t float64) float64 {
+	return t * t * (3 - 2*t)
+}
+
+// SetZoom sets the zoom level, between MIN_ZOOM and MAX_ZOOM
+func (view *View) SetZoom(zoom float64) {
+	view.zoom = math.Min(math.Max(zoom, MIN_ZOOM), MAX_ZOOM)
+	view.projection = getProjection(float32(view.zoom), view.shear)
+	for _, shader := range view.allShaders() {
+		gl.UseProgram(shader.program)
+		gl.UniformMatrix4fv(shader.projectionUniform, 1, false, &view.projection[0])
+	}
+}
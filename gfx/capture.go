@@ -0,0 +1,171 @@
+package gfx
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-gl/gl/all-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// max number of frames being written to disk at once while capturing a sequence
+const maxCaptureWriters = 4
+
+type Capture struct {
+	// a screenshot is taken at the end of the frame if this is not ""
+	screenshot     string
+	screenshotFull bool
+	// sequence capture
+	sequenceDir  string
+	sequenceFull bool
+	frame        int
+	writers      chan bool
+}
+
+func (app *App) captureDir(name string) string {
+	dir := filepath.Join(app.Dir, name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.Mkdir(dir, os.ModePerm)
+	}
+	return dir
+}
+
+// Screenshot saves the next frame in the screenshots dir and returns the file name. If windowSize is
+// true, the image is the size of the window, otherwise it's the low-res Width x Height.
+func (app *App) Screenshot(windowSize bool) string {
+	name := fmt.Sprintf("screenshot-%s.png", time.Now().Format("20060102-150405.000"))
+	app.capture.screenshot = filepath.Join(app.captureDir("screenshots"), name)
+	app.capture.screenshotFull = windowSize
+	return app.capture.screenshot
+}
+
+// StartCapture saves every frame as a numbered png in a new dir under captures, until StopCapture
+// is called. Returns the dir.
+func (app *App) StartCapture(windowSize bool) string {
+	dir := filepath.Join(app.captureDir("captures"), time.Now().Format("20060102-150405"))
+	os.Mkdir(dir, os.ModePerm)
+	app.capture.sequenceDir = dir
+	app.capture.sequenceFull = windowSize
+	app.capture.frame = 0
+	if app.capture.writers == nil {
+		app.capture.writers = make(chan bool, maxCaptureWriters)
+	}
+	fmt.Printf("Capturing frames to %s\n", dir)
+	return dir
+}
+
+func (app *App) StopCapture() {
+	if app.capture.sequenceDir != "" {
+		app.capture.wait()
+		fmt.Printf("Captured %d frames to %s\n", app.capture.frame, app.capture.sequenceDir)
+	}
+	app.capture.sequenceDir = ""
+}
+
+// wait for the frames being written: fill the writers channel, then empty it
+func (capture *Capture) wait() {
+	for i := 0; i < maxCaptureWriters; i++ {
+		capture.writers <- true
+	}
+	for i := 0; i < maxCaptureWriters; i++ {
+		<-capture.writers
+	}
+}
+
+func (app *App) IsCapturing() bool {
+	return app.capture.sequenceDir != ""
+}
+
+// F12: screenshot, shift+F12: window sized screenshot, ctrl+F12: start/stop capturing frames
+func (app *App) captureKeys() {
+	if app.IsFirstDownMod(glfw.KeyF12, glfw.ModControl) {
+		if app.IsCapturing() {
+			app.StopCapture()
+		} else {
+			app.StartCapture(false)
+		}
+	} else if app.IsFirstDownMod(glfw.KeyF12, glfw.ModShift) {
+		app.Screenshot(true)
+	} else if app.IsFirstDown(glfw.KeyF12) {
+		app.Screenshot(false)
+	}
+}
+
+// called after the frame is drawn, before the buffers are swapped
+func (app *App) captureFrame() {
+	if app.capture.screenshot != "" {
+		img := app.readFrame(app.capture.screenshotFull)
+		if err := writePng(app.capture.screenshot, img); err != nil {
+			fmt.Printf("Can't save screenshot: %v\n", err)
+		} else {
+			fmt.Printf("Saved screenshot: %s\n", app.capture.screenshot)
+		}
+		app.capture.screenshot = ""
+	}
+	if app.capture.sequenceDir != "" {
+		img := app.readFrame(app.capture.sequenceFull)
+		app.capture.frame++
+		path := filepath.Join(app.capture.sequenceDir, fmt.Sprintf("frame-%06d.png", app.capture.frame))
+		app.capture.writers <- true
+		go func() {
+			if err := writePng(path, img); err != nil {
+				fmt.Printf("Can't save frame: %v\n", err)
+			}
+			<-app.capture.writers
+		}()
+	}
+}
+
+// read the composed frame: the window's back buffer, or the scene (after the post process effects) and
+// ui frame buffers combined
+func (app *App) readFrame(windowSize bool) *image.RGBA {
+	if windowSize {
+		gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+		gl.ReadBuffer(gl.BACK)
+		return readPixels(app.windowWidthDpi, app.windowHeightDpi)
+	}
+	gl.BindFramebuffer(gl.FRAMEBUFFER, app.Post.outputFrameBuffer(app.frameBuffer.FrameBuffer))
+	img := readPixels(app.Width, app.Height)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, app.uiFrameBuffer.FrameBuffer)
+	ui := readPixels(app.Width, app.Height)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+
+	// same as the frame buffer shader: pixels with alpha < 0.1 are not drawn, then fade
+	for i := 0; i < len(img.Pix); i += 4 {
+		if ui.Pix[i+3] >= 26 {
+			copy(img.Pix[i:i+4], ui.Pix[i:i+4])
+		} else if img.Pix[i+3] < 26 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2] = 0, 0, 0
+		}
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = uint8(float32(img.Pix[i+c]) * app.fade)
+		}
+		img.Pix[i+3] = 255
+	}
+	return img
+}
+
+// read the bound frame buffer, flipped so the top row is first
+func readPixels(width, height int) *image.RGBA {
+	pix := make([]uint8, width*height*4)
+	gl.PixelStorei(gl.PACK_ALIGNMENT, 1)
+	gl.ReadPixels(0, 0, int32(width), int32(height), gl.RGBA, gl.UNSIGNED_BYTE, gl.Ptr(&pix[0]))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		copy(img.Pix[y*img.Stride:(y+1)*img.Stride], pix[(height-1-y)*width*4:(height-y)*width*4])
+	}
+	return img
+}
+
+func writePng(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
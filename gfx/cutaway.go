@@ -0,0 +1,173 @@
+package gfx
+
+import (
+	"math"
+	"sort"
+
+	"github.com/go-gl/gl/all-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/uzudil/isongn/shapes"
+	"github.com/uzudil/isongn/spatial"
+)
+
+// how fast shapes fade in and out (amount per second)
+const CUTAWAY_SPEED = 4
+
+// CutawayState fades the shapes that stand between the camera and a focus shape
+type CutawayState struct {
+	enabled bool
+	// the origin of the focus shape
+	focus [3]int
+	// screen space distance (in world units) from the focus where shapes fade
+	radius float32
+	// the shape groups that can fade, all groups if empty
+	groups map[int]bool
+	// alpha of a faded shape, 0 cuts it away
+	alpha float32
+	// how faded the shapes are (0-1), by origin
+	faded map[[3]int]float32
+	// the shapes to draw after the others
+	drawLast []*BlockPos
+	// focus center in eye space
+	focusEye mgl32.Vec4
+	// false if the focus shape wasn't found this frame (while a section loads, etc.): the fades are kept
+	focusFound bool
+}
+
+// SetCutaway fades shapes of the groups that are closer to the camera than the shape at worldX, worldY,
+// worldZ and within radius of it on the screen. The focus follows the shape when it's moved.
+func (view *View) SetCutaway(worldX, worldY, worldZ int, radius, alpha float32, groups []int) {
+	cutaway := &view.cutaway
+	cutaway.enabled = true
+	cutaway.focus = [3]int{worldX, worldY, worldZ}
+	cutaway.radius = radius
+	cutaway.alpha = alpha
+	cutaway.groups = map[int]bool{}
+	for _, group := range groups {
+		cutaway.groups[group] = true
+	}
+}
+
+// ClearCutaway stops fading, the faded shapes fade back in
+func (view *View) ClearCutaway() {
+	view.cutaway.enabled = false
+}
+
+func (cutaway *CutawayState) moved(cell *spatial.Cell, fromX, fromY, fromZ int) {
+	if cutaway.focus == [3]int{fromX, fromY, fromZ} {
+		cutaway.focus = [3]int{cell.WorldX, cell.WorldY, cell.WorldZ}
+	}
+}
+
+// the center of a shape in eye space
+func (view *View) eyePos(blockPos *BlockPos, shape *shapes.Shape) mgl32.Vec4 {
+	return view.camera.Mul4x1(mgl32.Vec4{
+		float32(blockPos.X-SIZE/2) + blockPos.ScrollOffset[0] + shape.Size[0]/2,
+		float32(blockPos.Y-SIZE/2) + blockPos.ScrollOffset[1] + shape.Size[1]/2,
+		float32(blockPos.Z) + shape.Size[2]/2,
+		1,
+	})
+}
+
+// called before drawing a frame
+func (view *View) updateCutaway() {
+	cutaway := &view.cutaway
+	cutaway.drawLast = cutaway.drawLast[:0]
+	cutaway.focusFound = false
+	if cutaway.enabled {
+		focus := view.GetBlockPos(cutaway.focus[0], cutaway.focus[1], cutaway.focus[2])
+		if focus != nil && focus.Pos.Block > 0 {
+			cutaway.focusEye = view.eyePos(focus, shapes.Shapes[focus.Pos.Block-1])
+			cutaway.focusFound = true
+		}
+	}
+	// forget the shapes that left the view or were removed
+	for key := range cutaway.faded {
+		if blockPos := view.GetBlockPos(key[0], key[1], key[2]); blockPos == nil || blockPos.Pos.Block == 0 {
+			delete(cutaway.faded, key)
+		}
+	}
+}
+
+func (view *View) occludesFocus(blockPos *BlockPos, shape *shapes.Shape) bool {
+	cutaway := &view.cutaway
+	if !cutaway.enabled || (len(cutaway.groups) > 0 && !cutaway.groups[shape.Group]) {
+		return false
+	}
+	if blockPos.WorldX == cutaway.focus[0] && blockPos.WorldY == cutaway.focus[1] && blockPos.WorldZ == cutaway.focus[2] {
+		return false
+	}
+	// the floor under the focus doesn't hide it
+	if float32(blockPos.WorldZ)+shape.Size[2] <= float32(cutaway.focus[2]) {
+		return false
+	}
+	eye := view.eyePos(blockPos, shape)
+	// the camera looks down the eye space z axis: closer is larger
+	if eye.Z() <= cutaway.focusEye.Z() {
+		return false
+	}
+	dx := eye.X() - cutaway.focusEye.X()
+	dy := eye.Y() - cutaway.focusEye.Y()
+	return float32(math.Sqrt(float64(dx*dx+dy*dy))) < cutaway.radius+float32(math.Max(float64(shape.Size[0]), float64(shape.Size[1])))/2
+}
+
+// isCutaway updates how faded the shape is and returns true if it's drawn after the others. In select
+// mode, mostly faded shapes are not drawn, so the shapes behind them can be clicked.
+func (view *View) isCutaway(blockPos *BlockPos, selectMode bool) bool {
+	cutaway := &view.cutaway
+	key := [3]int{blockPos.WorldX, blockPos.WorldY, blockPos.WorldZ}
+	amount := cutaway.faded[key]
+	if selectMode {
+		return amount > 0.5
+	}
+	shape := shapes.Shapes[blockPos.Pos.Block-1]
+	// while the focus is missing, the fades are kept
+	paused := cutaway.enabled && !cutaway.focusFound
+	if !paused && view.occludesFocus(blockPos, shape) {
+		amount = float32(math.Min(float64(amount+float32(state.delta)*CUTAWAY_SPEED), 1))
+	} else if !paused && amount > 0 {
+		amount = float32(math.Max(float64(amount-float32(state.delta)*CUTAWAY_SPEED), 0))
+	}
+	if amount <= 0 {
+		delete(cutaway.faded, key)
+		return false
+	}
+	cutaway.faded[key] = amount
+	cutaway.drawLast = append(cutaway.drawLast, blockPos)
+	return true
+}
+
+// draw the faded shapes over the others, without hiding what's behind them
+func (view *View) drawCutaway(shader *ViewShader) {
+	cutaway := &view.cutaway
+	if len(cutaway.drawLast) == 0 {
+		return
+	}
+	// blended back to front: closer is larger eye space z
+	depths := map[*BlockPos]float32{}
+	for _, blockPos := range cutaway.drawLast {
+		depths[blockPos] = view.eyePos(blockPos, shapes.Shapes[blockPos.Pos.Block-1]).Z()
+	}
+	sort.SliceStable(cutaway.drawLast, func(i, j int) bool {
+		return depths[cutaway.drawLast[i]] < depths[cutaway.drawLast[j]]
+	})
+	gl.DepthMask(false)
+	current := shader
+	for _, blockPos := range cutaway.drawLast {
+		amount := cutaway.faded[[3]int{blockPos.WorldX, blockPos.WorldY, blockPos.WorldZ}]
+		alpha := 1 - amount*(1-cutaway.alpha)
+		if alpha > 0 {
+			if s := view.shaderFor(blockPos); s != current {
+				current = s
+				view.useShader(current, false)
+			}
+			gl.Uniform1f(current.alphaUniform, alpha)
+			view.drawShape(blockPos, current)
+		}
+	}
+	if current != shader {
+		view.useShader(shader, false)
+	}
+	gl.Uniform1f(shader.alphaUniform, 1)
+	gl.DepthMask(true)
+}
@@ -85,11 +85,17 @@ func (fb *FrameBuffer) Enable(width, height int) {
 	gl.Viewport(0, 0, int32(width), int32(height))
 }
 
-func (fb *FrameBuffer) Draw(windowWidth, windowHeight int, fade float32) {
+// Draw renders to the screen, in the viewport: x, y, width, height
+func (fb *FrameBuffer) Draw(viewport [4]int, fade float32) {
+	fb.DrawTexture(fb.texture, viewport, fade)
+}
+
+// DrawTexture renders a texture the size of the frame buffer to the screen, for example the output of
+// the post process effects
+func (fb *FrameBuffer) DrawTexture(texture uint32, viewport [4]int, fade float32) {
 	// render to screen
 	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
-	// window size
-	gl.Viewport(0, 0, int32(windowWidth), int32(windowHeight))
+	gl.Viewport(int32(viewport[0]), int32(viewport[1]), int32(viewport[2]), int32(viewport[3]))
 	// gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
 	gl.Disable(gl.DEPTH_TEST)
 	gl.BindVertexArray(fb.vao)
@@ -98,12 +104,12 @@ func (fb *FrameBuffer) Draw(windowWidth, windowHeight int, fade float32) {
 	gl.UseProgram(fb.program)
 	gl.Uniform1i(fb.frameBufferTexID, 0)
 	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, fb.texture)
+	gl.BindTexture(gl.TEXTURE_2D, texture)
 	gl.BindBuffer(gl.ARRAY_BUFFER, fb.vbo)
 	gl.VertexAttribPointer(fb.vertAttrib, 3, gl.FLOAT, false, 5*4, gl.PtrOffset(0))
 	gl.VertexAttribPointer(fb.texCoordAttrib, 2, gl.FLOAT, false, 5*4, gl.PtrOffset(3*4))
 	if fb.useAspectRatio {
-		gl.Uniform1f(fb.aspectUniform, float32(windowWidth)/float32(windowHeight))
+		gl.Uniform1f(fb.aspectUniform, float32(viewport[2])/float32(viewport[3]))
 	} else {
 		gl.Uniform1f(fb.aspectUniform, 1)
 	}
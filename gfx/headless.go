@@ -0,0 +1,49 @@
+package gfx
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math/rand"
+)
+
+// NewHeadlessApp creates the app with a hidden window, at the game's resolution, for rendering without
+// user input (for example in CI with mesa's llvmpipe driver: LIBGL_ALWAYS_SOFTWARE=1 under xvfb-run).
+// Game state is saved to a new temp dir, so the user's saved games are not read or changed.
+func NewHeadlessApp(game Game, gameDir string, targetFps float64) *App {
+	return newApp(game, gameDir, 0, 0, targetFps, true)
+}
+
+func initTempdir(gameName string) string {
+	dir, err := ioutil.TempDir("", gameName+"-")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Game state path: %s\n", dir)
+	return dir
+}
+
+// RenderFrames draws frames with a fixed time step of 1/fps and returns the last one, composed at
+// Width x Height. Random effects (weather, particles) are seeded the same way for every call.
+func (app *App) RenderFrames(frames int) *image.RGBA {
+	if !app.started {
+		app.init()
+		app.started = true
+	}
+	rand.Seed(1)
+	state.time = 0
+	// use the weather of the region right away
+	app.View.Weather.region = -2
+	delta := 1 / app.targetFps
+	for i := 0; i < frames; i++ {
+		app.Game.Events(delta, app.fadeDir, 0, 0, 0, 0, 0, 0, false)
+
+		app.frameBuffer.Enable(app.Width, app.Height)
+		app.View.Draw(delta, false)
+		app.Post.Apply(app.frameBuffer.texture, delta)
+
+		app.uiFrameBuffer.Enable(app.Width, app.Height)
+		app.Ui.Draw()
+	}
+	return app.readFrame(false)
+}
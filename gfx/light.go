@@ -0,0 +1,111 @@
+package gfx
+
+import (
+	"math"
+	"sort"
+
+	"github.com/go-gl/gl/all-core/gl"
+	"github.com/uzudil/isongn/shapes"
+)
+
+// max number of lights used per frame (size of the shader uniform arrays)
+const MAX_LIGHTS = 16
+
+// a light placed by a script at a world position
+type PlacedLight struct {
+	X, Y, Z float32
+	Light   *shapes.Light
+}
+
+type frameLight struct {
+	pos   [3]float32
+	light *shapes.Light
+	seed  float32
+	dist  float32
+}
+
+type LightState struct {
+	placed map[int]*PlacedLight
+	handle int
+	frame  []frameLight
+	count  int32
+	pos    [MAX_LIGHTS][3]float32
+	color  [MAX_LIGHTS][3]float32
+	radius [MAX_LIGHTS]float32
+}
+
+func (view *View) AddLight(x, y, z float32, light *shapes.Light) int {
+	view.lights.handle++
+	view.lights.placed[view.lights.handle] = &PlacedLight{X: x, Y: y, Z: z, Light: light}
+	return view.lights.handle
+}
+
+func (view *View) DelLight(handle int) {
+	delete(view.lights.placed, handle)
+}
+
+// find the lights closest to the center of the view
+func (view *View) setLights() {
+	lights := &view.lights
+	lights.frame = lights.frame[:0]
+	centerX, centerY := view.Loader.GetCenter()
+	for handle, placed := range lights.placed {
+		lights.addFrameLight(placed.X-float32(centerX), placed.Y-float32(centerY), placed.Z, placed.Light, float32(handle))
+	}
+	view.traverseForDraw(func(x, y, z int) {
+		blockPos := view.blockPos[x][y][z]
+		if blockPos.Pos.Block > 0 && view.isVisible(blockPos) {
+			shape := shapes.Shapes[blockPos.Pos.Block-1]
+			if light := shape.Light; light != nil {
+				// where the shape is drawn: see CellChanged and the model scroll uniform
+				lights.addFrameLight(
+					float32(x-SIZE/2)+shape.Offset[0]+blockPos.ScrollOffset[0],
+					float32(y-SIZE/2)+shape.Offset[1]+blockPos.ScrollOffset[1],
+					float32(z)+shape.Offset[2]+blockPos.fallOffset,
+					light,
+					float32(blockPos.WorldX+blockPos.WorldY+blockPos.WorldZ),
+				)
+			}
+		}
+	})
+	sort.Slice(lights.frame, func(i, j int) bool { return lights.frame[i].dist < lights.frame[j].dist })
+
+	lights.count = 0
+	for _, fl := range lights.frame {
+		if lights.count >= MAX_LIGHTS {
+			break
+		}
+		brightness := float32(1)
+		if fl.light.Flicker > 0 {
+			t := state.time + float64(fl.seed)
+			noise := 0.5 + 0.25*math.Sin(t*7) + 0.25*math.Sin(t*13.3+1.7)
+			brightness -= fl.light.Flicker * float32(noise)
+		}
+		lights.pos[lights.count] = fl.pos
+		for i := 0; i < 3; i++ {
+			lights.color[lights.count][i] = fl.light.Color[i] * brightness
+		}
+		lights.radius[lights.count] = fl.light.Radius
+		lights.count++
+	}
+}
+
+// set the frame's lights on the shader
+func (lights *LightState) upload(shader *ViewShader) {
+	gl.Uniform1i(shader.lightCountUniform, lights.count)
+	if lights.count > 0 {
+		gl.Uniform3fv(shader.lightPosUniform, lights.count, &lights.pos[0][0])
+		gl.Uniform3fv(shader.lightColorUniform, lights.count, &lights.color[0][0])
+		gl.Uniform1fv(shader.lightRadiusUniform, lights.count, &lights.radius[0])
+	}
+}
+
+// x, y, z are relative to the center of the view
+func (lights *LightState) addFrameLight(x, y, z float32, light *shapes.Light, seed float32) {
+	pos := [3]float32{x + light.Offset[0], y + light.Offset[1], z + light.Offset[2]}
+	dist := pos[0]*pos[0] + pos[1]*pos[1]
+	if dist > DRAW_SIZE*DRAW_SIZE {
+		return
+	}
+	lights.frame = append(lights.frame, frameLight{pos: pos, light: light, seed: seed, dist: dist})
+}
@@ -0,0 +1,337 @@
+package gfx
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+
+	"github.com/go-gl/gl/all-core/gl"
+	"github.com/uzudil/isongn/shapes"
+)
+
+// floats per particle vertex: position, texture coordinates, color
+const particleVertexSize = 3 + 2 + 4
+
+// EmitterConfig describes the particles of an emitter. Colors are r,g,b,a in 0-1.
+type EmitterConfig struct {
+	texture *Texture
+	// part of the texture to draw: u, v, w, h
+	uv [4]float32
+	// particles per second
+	Rate float32
+	// seconds a particle lives (+/- 20%)
+	Lifetime float32
+	// initial velocity and its random variation (+/-) in world units per second
+	Velocity, Spread [3]float32
+	// pulls particles down (units per second^2), negative values make them rise
+	Gravity float32
+	// size at the start and end of a particle's life
+	SizeStart, SizeEnd float32
+	// color and alpha at the start and end of a particle's life
+	ColorStart, ColorEnd [4]float32
+	// seconds to emit for, 0 emits until stopped
+	Duration float32
+}
+
+type emitterParticle struct {
+	pos, vel       [3]float32
+	life, lifetime float32
+}
+
+// Emitter creates particles at a world position
+type Emitter struct {
+	X, Y, Z   float32
+	Config    *EmitterConfig
+	particles []emitterParticle
+	emitting  bool
+	elapsed   float32
+	spawn     float32
+}
+
+type ParticleState struct {
+	emitters          map[int]*Emitter
+	handle            int
+	vertices          []float32
+	uiTextures        map[string]*Texture
+	program           uint32
+	vao, vbo          uint32
+	projectionUniform int32
+	cameraUniform     int32
+	viewScrollUniform int32
+	posAttrib         uint32
+	texCoordAttrib    uint32
+	colorAttrib       uint32
+	initialized       bool
+}
+
+// NewEmitterConfig creates the emitter config from a script map. The sprite is the name of a shape
+// or a ui image. Colors are [r, g, b, a] in 0-255.
+func (view *View) NewEmitterConfig(def map[string]interface{}) (*EmitterConfig, error) {
+	config := &EmitterConfig{
+		uv:         [4]float32{0, 0, 1, 1},
+		Rate:       10,
+		Lifetime:   1,
+		SizeStart:  0.25,
+		SizeEnd:    0.25,
+		ColorStart: [4]float32{1, 1, 1, 1},
+		ColorEnd:   [4]float32{1, 1, 1, 0},
+	}
+	name, _ := def["sprite"].(string)
+	if shapeIndex, ok := shapes.Names[name]; ok {
+		shape := shapes.Shapes[shapeIndex]
+		config.texture = LoadTexture(shape.ImageIndex)
+		if shape.Tex != nil {
+			config.uv = [4]float32{shape.Tex.TexOffset[0], shape.Tex.TexOffset[1], shape.Tex.TexDim[0], shape.Tex.TexDim[1]}
+		}
+	} else if img, ok := shapes.UiImages[name]; ok {
+		config.texture = view.particles.uiTexture(name, img)
+	} else {
+		return nil, fmt.Errorf("unknown particle sprite: %s", name)
+	}
+	getFloat := func(key string, value *float32) {
+		if v, ok := def[key].(float64); ok {
+			*value = float32(v)
+		}
+	}
+	getVector := func(key string, value []float32, scale float32) error {
+		v, ok := def[key].(*[]interface{})
+		if !ok {
+			return nil
+		}
+		if len(*v) != len(value) {
+			return fmt.Errorf("particle %s should have %d values", key, len(value))
+		}
+		for i := range value {
+			f, ok := (*v)[i].(float64)
+			if !ok {
+				return fmt.Errorf("particle %s should be numbers", key)
+			}
+			value[i] = float32(f) / scale
+		}
+		return nil
+	}
+	getFloat("rate", &config.Rate)
+	getFloat("lifetime", &config.Lifetime)
+	getFloat("gravity", &config.Gravity)
+	getFloat("duration", &config.Duration)
+	getFloat("size", &config.SizeStart)
+	config.SizeEnd = config.SizeStart
+	getFloat("sizeEnd", &config.SizeEnd)
+	if err := getVector("velocity", config.Velocity[:], 1); err != nil {
+		return nil, err
+	}
+	if err := getVector("spread", config.Spread[:], 1); err != nil {
+		return nil, err
+	}
+	if err := getVector("color", config.ColorStart[:], 255); err != nil {
+		return nil, err
+	}
+	config.ColorEnd = config.ColorStart
+	config.ColorEnd[3] = 0
+	if err := getVector("colorEnd", config.ColorEnd[:], 255); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (particles *ParticleState) uiTexture(name string, img image.Image) *Texture {
+	tex, ok := particles.uiTextures[name]
+	if !ok {
+		texID, err := loadTexture(img)
+		if err != nil {
+			panic(err)
+		}
+		tex = &Texture{texture: texID}
+		particles.uiTextures[name] = tex
+	}
+	return tex
+}
+
+// StartEmitter starts emitting particles at a world position and returns its handle
+func (view *View) StartEmitter(x, y, z float32, config *EmitterConfig) int {
+	view.particles.handle++
+	view.particles.emitters[view.particles.handle] = &Emitter{X: x, Y: y, Z: z, Config: config, emitting: true}
+	return view.particles.handle
+}
+
+func (view *View) MoveEmitter(handle int, x, y, z float32) {
+	if emitter, ok := view.particles.emitters[handle]; ok {
+		emitter.X = x
+		emitter.Y = y
+		emitter.Z = z
+	}
+}
+
+// StopEmitter stops creating particles, the emitter is removed when its particles are gone
+func (view *View) StopEmitter(handle int) {
+	if emitter, ok := view.particles.emitters[handle]; ok {
+		emitter.emitting = false
+	}
+}
+
+// DelEmitter removes the emitter and its particles right away
+func (view *View) DelEmitter(handle int) {
+	delete(view.particles.emitters, handle)
+}
+
+func (view *View) updateParticles(delta float32) {
+	for handle, emitter := range view.particles.emitters {
+		emitter.update(delta)
+		if !emitter.emitting && len(emitter.particles) == 0 {
+			delete(view.particles.emitters, handle)
+		}
+	}
+}
+
+func (emitter *Emitter) update(delta float32) {
+	config := emitter.Config
+	if emitter.emitting {
+		emitter.elapsed += delta
+		if config.Duration > 0 && emitter.elapsed >= config.Duration {
+			emitter.emitting = false
+		}
+		emitter.spawn += config.Rate * delta
+		for ; emitter.spawn >= 1; emitter.spawn-- {
+			p := emitterParticle{
+				pos:      [3]float32{emitter.X, emitter.Y, emitter.Z},
+				lifetime: config.Lifetime * (0.8 + rand.Float32()*0.4),
+			}
+			for i := range p.vel {
+				p.vel[i] = config.Velocity[i] + (rand.Float32()*2-1)*config.Spread[i]
+			}
+			emitter.particles = append(emitter.particles, p)
+		}
+	}
+	alive := emitter.particles[:0]
+	for _, p := range emitter.particles {
+		p.life += delta
+		if p.life >= p.lifetime {
+			continue
+		}
+		p.vel[2] -= config.Gravity * delta
+		for i := range p.pos {
+			p.pos[i] += p.vel[i] * delta
+		}
+		alive = append(alive, p)
+	}
+	emitter.particles = alive
+}
+
+func (particles *ParticleState) init() {
+	var err error
+	particles.program, err = NewProgram(emitterVertexShader, emitterFragmentShader)
+	if err != nil {
+		panic(err)
+	}
+	gl.UseProgram(particles.program)
+	particles.projectionUniform = gl.GetUniformLocation(particles.program, gl.Str("projection\x00"))
+	particles.cameraUniform = gl.GetUniformLocation(particles.program, gl.Str("camera\x00"))
+	particles.viewScrollUniform = gl.GetUniformLocation(particles.program, gl.Str("viewScroll\x00"))
+	gl.Uniform1i(gl.GetUniformLocation(particles.program, gl.Str("tex\x00")), 0)
+	gl.BindFragDataLocation(particles.program, 0, gl.Str("outputColor\x00"))
+	particles.posAttrib = uint32(gl.GetAttribLocation(particles.program, gl.Str("vert\x00")))
+	particles.texCoordAttrib = uint32(gl.GetAttribLocation(particles.program, gl.Str("vertTexCoord\x00")))
+	particles.colorAttrib = uint32(gl.GetAttribLocation(particles.program, gl.Str("vertColor\x00")))
+	gl.GenVertexArrays(1, &particles.vao)
+	gl.GenBuffers(1, &particles.vbo)
+	particles.initialized = true
+}
+
+// draw the particles as camera facing quads, depth tested against the scene
+func (view *View) drawParticles() {
+	particles := &view.particles
+	if len(particles.emitters) == 0 {
+		return
+	}
+	if !particles.initialized {
+		particles.init()
+	}
+	gl.UseProgram(particles.program)
+	gl.UniformMatrix4fv(particles.projectionUniform, 1, false, &view.projection[0])
+	gl.UniformMatrix4fv(particles.cameraUniform, 1, false, &view.camera[0])
+	viewScroll := view.viewScroll()
+	gl.Uniform3fv(particles.viewScrollUniform, 1, &viewScroll[0])
+	gl.BindVertexArray(particles.vao)
+	gl.BindBuffer(gl.ARRAY_BUFFER, particles.vbo)
+	gl.EnableVertexAttribArray(particles.posAttrib)
+	gl.EnableVertexAttribArray(particles.texCoordAttrib)
+	gl.EnableVertexAttribArray(particles.colorAttrib)
+	gl.VertexAttribPointer(particles.posAttrib, 3, gl.FLOAT, false, particleVertexSize*4, gl.PtrOffset(0))
+	gl.VertexAttribPointer(particles.texCoordAttrib, 2, gl.FLOAT, false, particleVertexSize*4, gl.PtrOffset(3*4))
+	gl.VertexAttribPointer(particles.colorAttrib, 4, gl.FLOAT, false, particleVertexSize*4, gl.PtrOffset(5*4))
+	gl.DepthMask(false)
+
+	// billboard axes: the camera's right and up in world space
+	right := view.camera.Row(0).Vec3()
+	up := view.camera.Row(1).Vec3()
+	centerX, centerY := view.Loader.GetCenter()
+	for _, emitter := range particles.emitters {
+		if len(emitter.particles) == 0 {
+			continue
+		}
+		config := emitter.Config
+		particles.vertices = particles.vertices[:0]
+		for _, p := range emitter.particles {
+			t := p.life / p.lifetime
+			size := (config.SizeStart + (config.SizeEnd-config.SizeStart)*t) / 2
+			var color [4]float32
+			for i := range color {
+				color[i] = config.ColorStart[i] + (config.ColorEnd[i]-config.ColorStart[i])*t
+			}
+			x := p.pos[0] - float32(centerX)
+			y := p.pos[1] - float32(centerY)
+			z := p.pos[2]
+			corner := func(sx, sy, u, v float32) {
+				particles.vertices = append(particles.vertices,
+					x+(right[0]*sx+up[0]*sy)*size,
+					y+(right[1]*sx+up[1]*sy)*size,
+					z+(right[2]*sx+up[2]*sy)*size,
+					config.uv[0]+u*config.uv[2], config.uv[1]+v*config.uv[3],
+					color[0], color[1], color[2], color[3],
+				)
+			}
+			corner(-1, -1, 0, 1)
+			corner(1, -1, 1, 1)
+			corner(1, 1, 1, 0)
+			corner(-1, -1, 0, 1)
+			corner(1, 1, 1, 0)
+			corner(-1, 1, 0, 0)
+		}
+		gl.BindTexture(gl.TEXTURE_2D, config.texture.texture)
+		gl.BufferData(gl.ARRAY_BUFFER, len(particles.vertices)*4, gl.Ptr(particles.vertices), gl.DYNAMIC_DRAW)
+		gl.DrawArrays(gl.TRIANGLES, 0, int32(len(particles.vertices)/particleVertexSize))
+	}
+	gl.DepthMask(true)
+}
+
+var emitterVertexShader = `
+#version 330
+uniform mat4 projection;
+uniform mat4 camera;
+uniform vec3 viewScroll;
+in vec3 vert;
+in vec2 vertTexCoord;
+in vec4 vertColor;
+out vec2 fragTexCoord;
+out vec4 fragColor;
+void main() {
+	fragTexCoord = vertTexCoord;
+	fragColor = vertColor;
+	gl_Position = projection * camera * vec4(vert - viewScroll, 1);
+}
+` + "\x00"
+
+var emitterFragmentShader = `
+#version 330
+uniform sampler2D tex;
+in vec2 fragTexCoord;
+in vec4 fragColor;
+layout(location = 0) out vec4 outputColor;
+void main() {
+	vec4 val = texture(tex, fragTexCoord) * fragColor;
+	if (val.a < 0.01) {
+		discard;
+	}
+	outputColor = val;
+}
+` + "\x00"
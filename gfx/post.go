@@ -0,0 +1,425 @@
+package gfx
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/all-core/gl"
+)
+
+// max colors of the palette effect
+const MAX_PALETTE = 64
+
+// PostEffect is a full screen pass over the scene
+type PostEffect struct {
+	Name    string
+	Effect  string
+	Enabled bool
+	// uniform values by name, 1 to 4 floats
+	params   map[string][]float32
+	program  uint32
+	uniforms map[string]int32
+	// palette effect colors, r, g, b in 0-1
+	palette []float32
+}
+
+type postTarget struct {
+	frameBuffer uint32
+	texture     uint32
+}
+
+// PostChain runs the enabled effects in order over the scene at Width x Height
+type PostChain struct {
+	Effects       []*PostEffect
+	width, height int32
+	targets       [2]postTarget
+	vao, vbo      uint32
+	output        uint32
+	time          float32
+	initialized   bool
+}
+
+type postEffectDef struct {
+	shader string
+	params map[string][]float32
+}
+
+// the built-in effects: shader and default uniform values
+var postEffects = map[string]postEffectDef{
+	"scanlines":  {scanlinesShader, map[string][]float32{"intensity": {0.25}}},
+	"palette":    {paletteShader, map[string][]float32{"dither": {0}}},
+	"vignette":   {vignetteShader, map[string][]float32{"intensity": {0.5}, "radius": {0.75}}},
+	"bloom":      {bloomShader, map[string][]float32{"threshold": {0.7}, "intensity": {0.6}, "spread": {2}}},
+	"desaturate": {desaturateShader, map[string][]float32{"amount": {1}, "tint": {1, 1, 1}}},
+	"colorblind": {colorblindShader, map[string][]float32{"mode": {1}, "amount": {1}}},
+}
+
+// NewPostChain creates the effects from the "postProcess" config list. Each entry has an "effect"
+// (scanlines, palette, vignette, bloom, desaturate, colorblind), an optional "name" (default: the
+// effect), "enabled" (default: true) and the effect's uniforms, for example "intensity": 0.3.
+// The palette effect takes "colors": [[r, g, b], ...] in 0-255.
+func NewPostChain(config []map[string]interface{}, width, height int) *PostChain {
+	chain := &PostChain{width: int32(width), height: int32(height)}
+	for _, def := range config {
+		effectName, ok := def["effect"].(string)
+		if !ok {
+			panic("Post process entry needs an effect")
+		}
+		effectDef, ok := postEffects[effectName]
+		if !ok {
+			panic(fmt.Sprintf("Unknown post process effect: %s", effectName))
+		}
+		effect := &PostEffect{
+			Name:    effectName,
+			Effect:  effectName,
+			Enabled: true,
+			params:  map[string][]float32{},
+		}
+		for k, v := range effectDef.params {
+			effect.params[k] = append([]float32{}, v...)
+		}
+		for k, v := range def {
+			switch k {
+			case "effect":
+			case "name":
+				effect.Name = v.(string)
+			case "enabled":
+				effect.Enabled = v.(bool)
+			case "colors":
+				palette, err := parsePalette(v)
+				if err != nil {
+					panic(err)
+				}
+				effect.palette = palette
+			default:
+				if err := effect.setParam(k, v); err != nil {
+					panic(err)
+				}
+			}
+		}
+		chain.Effects = append(chain.Effects, effect)
+	}
+	return chain
+}
+
+func parsePalette(value interface{}) ([]float32, error) {
+	colors, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("palette colors should be a list of [r, g, b]")
+	}
+	if len(colors) > MAX_PALETTE {
+		return nil, fmt.Errorf("palette has more than %d colors", MAX_PALETTE)
+	}
+	palette := []float32{}
+	for _, c := range colors {
+		rgb, ok := c.([]interface{})
+		if !ok || len(rgb) != 3 {
+			return nil, fmt.Errorf("palette colors should be a list of [r, g, b]")
+		}
+		for _, n := range rgb {
+			f, ok := n.(float64)
+			if !ok {
+				return nil, fmt.Errorf("palette colors should be numbers")
+			}
+			palette = append(palette, float32(f)/255)
+		}
+	}
+	return palette, nil
+}
+
+// setParam sets a uniform from a number or a list of numbers, as many as the effect's default
+func (effect *PostEffect) setParam(name string, value interface{}) error {
+	def, ok := postEffects[effect.Effect].params[name]
+	if !ok {
+		return fmt.Errorf("unknown parameter %s of post process effect %s", name, effect.Effect)
+	}
+	values := []float32{}
+	switch v := value.(type) {
+	case float64:
+		values = append(values, float32(v))
+	case bool:
+		if v {
+			values = append(values, 1)
+		} else {
+			values = append(values, 0)
+		}
+	case []interface{}:
+		for _, n := range v {
+			f, ok := n.(float64)
+			if !ok {
+				return fmt.Errorf("parameter %s of post process effect %s should be numbers", name, effect.Effect)
+			}
+			values = append(values, float32(f))
+		}
+	default:
+		return fmt.Errorf("parameter %s of post process effect %s should be a number or a list", name, effect.Effect)
+	}
+	if len(values) != len(def) {
+		return fmt.Errorf("parameter %s of post process effect %s should have %d values", name, effect.Effect, len(def))
+	}
+	effect.params[name] = values
+	return nil
+}
+
+func (chain *PostChain) Get(name string) (*PostEffect, error) {
+	for _, effect := range chain.Effects {
+		if effect.Name == name {
+			return effect, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown post process effect: %s", name)
+}
+
+// SetEnabled turns the named effect on or off
+func (chain *PostChain) SetEnabled(name string, enabled bool) error {
+	effect, err := chain.Get(name)
+	if err != nil {
+		return err
+	}
+	effect.Enabled = enabled
+	return nil
+}
+
+// SetParam sets a uniform of the named effect. For the palette effect, "colors" sets the palette.
+func (chain *PostChain) SetParam(name, param string, value interface{}) error {
+	effect, err := chain.Get(name)
+	if err != nil {
+		return err
+	}
+	if param == "colors" && effect.Effect == "palette" {
+		palette, err := parsePalette(value)
+		if err != nil {
+			return err
+		}
+		effect.palette = palette
+		return nil
+	}
+	return effect.setParam(param, value)
+}
+
+func (chain *PostChain) init() {
+	for i := range chain.targets {
+		target := &chain.targets[i]
+		gl.GenFramebuffers(1, &target.frameBuffer)
+		gl.BindFramebuffer(gl.FRAMEBUFFER, target.frameBuffer)
+		gl.GenTextures(1, &target.texture)
+		gl.BindTexture(gl.TEXTURE_2D, target.texture)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA, chain.width, chain.height, 0, gl.RGBA, gl.UNSIGNED_BYTE, nil)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+		gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+		gl.FramebufferTexture(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0, target.texture, 0)
+		if gl.CheckFramebufferStatus(gl.FRAMEBUFFER) != gl.FRAMEBUFFER_COMPLETE {
+			panic("Can't configure post process framebuffer!")
+		}
+	}
+
+	gl.GenVertexArrays(1, &chain.vao)
+	gl.BindVertexArray(chain.vao)
+	gl.GenBuffers(1, &chain.vbo)
+	gl.BindBuffer(gl.ARRAY_BUFFER, chain.vbo)
+	verts := []float32{
+		-1, -1, 0, 0,
+		-1, 1, 0, 1,
+		1, 1, 1, 1,
+		1, 1, 1, 1,
+		1, -1, 1, 0,
+		-1, -1, 0, 0,
+	}
+	gl.BufferData(gl.ARRAY_BUFFER, len(verts)*4, gl.Ptr(verts), gl.STATIC_DRAW)
+
+	for _, effect := range chain.Effects {
+		var err error
+		effect.program, err = NewProgram(postVertexShader, postEffects[effect.Effect].shader+"\x00")
+		if err != nil {
+			panic(err)
+		}
+		gl.BindFragDataLocation(effect.program, 0, gl.Str("outputColor\x00"))
+		effect.uniforms = map[string]int32{}
+		names := []string{"tex", "resolution", "time", "paletteCount", "palette"}
+		for k := range effect.params {
+			names = append(names, k)
+		}
+		for _, name := range names {
+			effect.uniforms[name] = gl.GetUniformLocation(effect.program, gl.Str(name+"\x00"))
+		}
+	}
+	chain.initialized = true
+}
+
+// Apply runs the enabled effects over the texture and returns the resulting texture
+func (chain *PostChain) Apply(texture uint32, delta float64) uint32 {
+	chain.output = 0
+	chain.time += float32(delta)
+	if len(chain.Effects) == 0 {
+		return texture
+	}
+	if !chain.initialized {
+		chain.init()
+	}
+	gl.Disable(gl.DEPTH_TEST)
+	gl.Disable(gl.BLEND)
+	gl.Viewport(0, 0, chain.width, chain.height)
+	gl.BindVertexArray(chain.vao)
+	gl.BindBuffer(gl.ARRAY_BUFFER, chain.vbo)
+	gl.ActiveTexture(gl.TEXTURE0)
+	target := 0
+	for _, effect := range chain.Effects {
+		if !effect.Enabled {
+			continue
+		}
+		gl.BindFramebuffer(gl.FRAMEBUFFER, chain.targets[target].frameBuffer)
+		gl.UseProgram(effect.program)
+		posAttrib := uint32(gl.GetAttribLocation(effect.program, gl.Str("vert\x00")))
+		texCoordAttrib := uint32(gl.GetAttribLocation(effect.program, gl.Str("vertTexCoord\x00")))
+		gl.EnableVertexAttribArray(posAttrib)
+		gl.EnableVertexAttribArray(texCoordAttrib)
+		gl.VertexAttribPointer(posAttrib, 2, gl.FLOAT, false, 4*4, gl.PtrOffset(0))
+		gl.VertexAttribPointer(texCoordAttrib, 2, gl.FLOAT, false, 4*4, gl.PtrOffset(2*4))
+		gl.BindTexture(gl.TEXTURE_2D, texture)
+		effect.setUniforms(chain)
+		gl.DrawArrays(gl.TRIANGLES, 0, 6)
+		texture = chain.targets[target].texture
+		chain.output = chain.targets[target].frameBuffer
+		target = 1 - target
+	}
+	gl.Enable(gl.BLEND)
+	gl.Enable(gl.DEPTH_TEST)
+	return texture
+}
+
+// the frame buffer with the last Apply's result, or the default if no effects were applied
+func (chain *PostChain) outputFrameBuffer(defaultFrameBuffer uint32) uint32 {
+	if chain.output == 0 {
+		return defaultFrameBuffer
+	}
+	return chain.output
+}
+
+func (effect *PostEffect) setUniforms(chain *PostChain) {
+	gl.Uniform1i(effect.uniforms["tex"], 0)
+	gl.Uniform2f(effect.uniforms["resolution"], float32(chain.width), float32(chain.height))
+	gl.Uniform1f(effect.uniforms["time"], chain.time)
+	if len(effect.palette) > 0 {
+		gl.Uniform1i(effect.uniforms["paletteCount"], int32(len(effect.palette)/3))
+		gl.Uniform3fv(effect.uniforms["palette"], int32(len(effect.palette)/3), &effect.palette[0])
+	} else {
+		gl.Uniform1i(effect.uniforms["paletteCount"], 0)
+	}
+	for name, v := range effect.params {
+		setUniformFloats(effect.uniforms[name], v)
+	}
+}
+
+var postVertexShader = `
+#version 330
+in vec2 vert;
+in vec2 vertTexCoord;
+out vec2 fragTexCoord;
+void main() {
+	fragTexCoord = vertTexCoord;
+	gl_Position = vec4(vert, 0, 1);
+}
+` + "\x00"
+
+const postHeader = `
+#version 330
+uniform sampler2D tex;
+uniform vec2 resolution;
+uniform float time;
+in vec2 fragTexCoord;
+layout(location = 0) out vec4 outputColor;
+`
+
+// darken every other row
+var scanlinesShader = postHeader + `
+uniform float intensity;
+void main() {
+	vec4 val = texture(tex, fragTexCoord);
+	float row = mod(floor(fragTexCoord.y * resolution.y), 2.0);
+	outputColor = vec4(val.rgb * (1.0 - intensity * row), val.a);
+}
+`
+
+// snap each color to the closest palette color, with optional ordered dithering
+var paletteShader = postHeader + `
+uniform int paletteCount;
+uniform vec3 palette[` + fmt.Sprint(MAX_PALETTE) + `];
+uniform float dither;
+const float bayer[16] = float[](0.0, 8.0, 2.0, 10.0, 12.0, 4.0, 14.0, 6.0, 3.0, 11.0, 1.0, 9.0, 15.0, 7.0, 13.0, 5.0);
+void main() {
+	vec4 val = texture(tex, fragTexCoord);
+	vec2 p = mod(floor(fragTexCoord * resolution), 4.0);
+	vec3 c = val.rgb + dither * (bayer[int(p.y) * 4 + int(p.x)] / 16.0 - 0.5) / 8.0;
+	vec3 best = c;
+	float bestDistance = 1000.0;
+	for (int i = 0; i < paletteCount; i++) {
+		float d = distance(c, palette[i]);
+		if (d < bestDistance) {
+			bestDistance = d;
+			best = palette[i];
+		}
+	}
+	outputColor = vec4(best, val.a);
+}
+`
+
+// darken towards the edges
+var vignetteShader = postHeader + `
+uniform float intensity;
+uniform float radius;
+void main() {
+	vec4 val = texture(tex, fragTexCoord);
+	float d = distance(fragTexCoord, vec2(0.5)) / 0.7071;
+	float v = 1.0 - intensity * smoothstep(radius, 1.0, d);
+	outputColor = vec4(val.rgb * v, val.a);
+}
+`
+
+// add a blur of the bright parts
+var bloomShader = postHeader + `
+uniform float threshold;
+uniform float intensity;
+uniform float spread;
+void main() {
+	vec4 val = texture(tex, fragTexCoord);
+	vec3 glow = vec3(0.0);
+	for (int x = -2; x <= 2; x++) {
+		for (int y = -2; y <= 2; y++) {
+			vec3 c = texture(tex, fragTexCoord + vec2(x, y) * spread / resolution).rgb;
+			float brightness = max(c.r, max(c.g, c.b));
+			glow += c * smoothstep(threshold, 1.0, brightness);
+		}
+	}
+	outputColor = vec4(val.rgb + glow / 25.0 * intensity, val.a);
+}
+`
+
+// grayscale, optionally tinted (for example sepia for flashbacks)
+var desaturateShader = postHeader + `
+uniform float amount;
+uniform vec3 tint;
+void main() {
+	vec4 val = texture(tex, fragTexCoord);
+	float gray = dot(val.rgb, vec3(0.299, 0.587, 0.114));
+	outputColor = vec4(mix(val.rgb, gray * tint, amount), val.a);
+}
+`
+
+// simulate color blindness, mode: 1 protanopia, 2 deuteranopia, 3 tritanopia
+var colorblindShader = postHeader + `
+uniform float mode;
+uniform float amount;
+void main() {
+	vec4 val = texture(tex, fragTexCoord);
+	mat3 m = mat3(1.0);
+	if (mode < 1.5) {
+		m = mat3(0.567, 0.558, 0.0, 0.433, 0.442, 0.242, 0.0, 0.0, 0.758);
+	} else if (mode < 2.5) {
+		m = mat3(0.625, 0.7, 0.0, 0.375, 0.3, 0.3, 0.0, 0.0, 0.7);
+	} else {
+		m = mat3(0.95, 0.0, 0.0, 0.05, 0.433, 0.475, 0.0, 0.567, 0.525);
+	}
+	outputColor = vec4(mix(val.rgb, m * val.rgb, amount), val.a);
+}
+`
@@ -2,9 +2,11 @@ package gfx
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/go-gl/gl/all-core/gl"
+	"github.com/uzudil/isongn/shapes"
 )
 
 func NewProgram(vertexShaderSource, fragmentShaderSource string) (uint32, error) {
@@ -66,30 +68,173 @@ func compileShader(source string, shaderType uint32) (uint32, error) {
 }
 
 type ViewShader struct {
-	program               uint32
-	projectionUniform     int32
-	cameraUniform         int32
-	modelUniform          int32
-	textureUniform        int32
-	textureOffsetUniform  int32
-	alphaMinUniform       int32
-	daylightUniform       int32
-	viewScrollUniform     int32
-	modelScrollUniform    int32
-	timeUniform           int32
-	heightUniform         int32
-	uniqueOffsetUniform   int32
-	swayEnabledUniform    int32
-	bobEnabledUniform     int32
-	breatheEnabledUniform int32
-	selectModeUniform     int32
-	vertAttrib            uint32
-	texCoordAttrib        uint32
+	program                  uint32
+	projectionUniform        int32
+	cameraUniform            int32
+	modelUniform             int32
+	textureUniform           int32
+	textureOffsetUniform     int32
+	alphaMinUniform          int32
+	alphaUniform             int32
+	daylightUniform          int32
+	viewScrollUniform        int32
+	modelScrollUniform       int32
+	timeUniform              int32
+	heightUniform            int32
+	uniqueOffsetUniform      int32
+	swayEnabledUniform       int32
+	bobEnabledUniform        int32
+	breatheEnabledUniform    int32
+	selectModeUniform        int32
+	variantEnabledUniform    int32
+	variantHsvUniform        int32
+	variantRemapCountUniform int32
+	variantRemapFromUniform  int32
+	variantRemapToUniform    int32
+	variantToleranceUniform  int32
+	lightCountUniform        int32
+	lightPosUniform          int32
+	lightColorUniform        int32
+	lightRadiusUniform       int32
+	swayAmountUniform        int32
+	fogUniform               int32
+	flashUniform             int32
+	vertAttrib               uint32
+	texCoordAttrib           uint32
+	// uniforms of a custom shader: location and default value by name
+	params        map[string]int32
+	paramDefaults map[string][]float32
 }
 
+// CustomShader is a named shader from the config. Its glsl snippets replace the vertexEffect and
+// fragmentEffect functions of the view's shaders.
+type CustomShader struct {
+	Name         string
+	shader       *ViewShader
+	selectShader *ViewShader
+	// the shapes to draw with this shader in the current frame
+	draws []*BlockPos
+}
+
+// the hooks custom shaders replace: an offset added to the vertex and a change of the texture color
+const (
+	defaultVertexEffect   = "vec3 vertexEffect(vec3 vert) { return vec3(0.0); }"
+	defaultFragmentEffect = "vec4 fragmentEffect(vec4 color) { return color; }"
+	effectMarker          = "// effect\n"
+)
+
 func (view *View) initShaders() {
-	view.shaders = view.initProgram(vertexShader, fragmentShader)
-	view.selectShaders = view.initProgram(vertexShader, selectFragmentShader)
+	vertex := withEffect(vertexShader, defaultVertexEffect)
+	view.shaders = view.initProgram(vertex, withEffect(fragmentShader, defaultFragmentEffect))
+	view.selectShaders = view.initProgram(vertex, selectFragmentShader)
+}
+
+func withEffect(source, effect string) string {
+	return strings.Replace(source, effectMarker, effect+"\n", 1)
+}
+
+// AddShaders compiles the custom shaders from the config and assigns them to the shapes that use them.
+// A shader is {"vertex": glsl, "fragment": glsl, "params": {name: value}}, where vertex defines
+// vertexEffect, fragment defines fragmentEffect (either can be omitted) and params are the float
+// uniforms they declare with their default values. The snippets can be strings or lists of lines.
+func (view *View) AddShaders(config map[string]interface{}) {
+	for name, v := range config {
+		def := v.(map[string]interface{})
+		vertex := withEffect(vertexShader, shaderSource(def, "vertex", defaultVertexEffect))
+		fragment := withEffect(fragmentShader, shaderSource(def, "fragment", defaultFragmentEffect))
+		defaults := map[string][]float32{}
+		if params, ok := def["params"].(map[string]interface{}); ok {
+			for k, value := range params {
+				defaults[k] = shapes.ParseShaderParam(value)
+			}
+		}
+		view.customShaders[name] = &CustomShader{
+			Name:         name,
+			shader:       view.initCustomProgram(vertex, fragment, defaults),
+			selectShader: view.initCustomProgram(vertex, selectFragmentShader, defaults),
+		}
+	}
+	// draw in the same order every frame
+	view.customShaderList = view.customShaderList[:0]
+	for _, custom := range view.customShaders {
+		view.customShaderList = append(view.customShaderList, custom)
+	}
+	sort.Slice(view.customShaderList, func(i, j int) bool {
+		return view.customShaderList[i].Name < view.customShaderList[j].Name
+	})
+	for index, shape := range shapes.Shapes {
+		if shape == nil || shape.Shader == "" {
+			continue
+		}
+		custom, ok := view.customShaders[shape.Shader]
+		if !ok {
+			panic(fmt.Sprintf("Unknown shader %s in shape %s", shape.Shader, shape.Name))
+		}
+		for k := range shape.ShaderParams {
+			if _, ok := custom.shader.paramDefaults[k]; !ok {
+				panic(fmt.Sprintf("Unknown parameter %s of shader %s in shape %s", k, shape.Shader, shape.Name))
+			}
+		}
+		view.blocks[index].custom = custom
+	}
+}
+
+func shaderSource(def map[string]interface{}, key, defaultSource string) string {
+	switch v := def[key].(type) {
+	case string:
+		return v
+	case []interface{}:
+		lines := []string{}
+		for _, line := range v {
+			lines = append(lines, line.(string))
+		}
+		return strings.Join(lines, "\n")
+	}
+	return defaultSource
+}
+
+func (view *View) initCustomProgram(vertexShader, fragmentShader string, defaults map[string][]float32) *ViewShader {
+	vs := view.initProgram(vertexShader, fragmentShader)
+	vs.params = map[string]int32{}
+	vs.paramDefaults = defaults
+	for name := range defaults {
+		vs.params[name] = gl.GetUniformLocation(vs.program, gl.Str(name+"\x00"))
+	}
+	return vs
+}
+
+// all the programs that draw shapes
+func (view *View) allShaders() []*ViewShader {
+	all := []*ViewShader{view.shaders, view.selectShaders}
+	for _, custom := range view.customShaderList {
+		all = append(all, custom.shader, custom.selectShader)
+	}
+	return all
+}
+
+// set the custom shader's uniforms from the shape, or their defaults
+func setShaderParams(shader *ViewShader, shape *shapes.Shape) {
+	for name, location := range shader.params {
+		value, ok := shape.ShaderParams[name]
+		if !ok {
+			value = shader.paramDefaults[name]
+		}
+		setUniformFloats(location, value)
+	}
+}
+
+// set a float, vec2, vec3 or vec4 uniform
+func setUniformFloats(location int32, value []float32) {
+	switch len(value) {
+	case 1:
+		gl.Uniform1f(location, value[0])
+	case 2:
+		gl.Uniform2f(location, value[0], value[1])
+	case 3:
+		gl.Uniform3f(location, value[0], value[1], value[2])
+	case 4:
+		gl.Uniform4f(location, value[0], value[1], value[2], value[3])
+	}
 }
 
 func (view *View) initProgram(vertexShader, fragmentShader string) *ViewShader {
@@ -115,8 +260,22 @@ func (view *View) initProgram(vertexShader, fragmentShader string) *ViewShader {
 	vs.textureUniform = gl.GetUniformLocation(vs.program, gl.Str("tex\x00"))
 	vs.textureOffsetUniform = gl.GetUniformLocation(vs.program, gl.Str("textureOffset\x00"))
 	vs.alphaMinUniform = gl.GetUniformLocation(vs.program, gl.Str("alphaMin\x00"))
+	vs.alphaUniform = gl.GetUniformLocation(vs.program, gl.Str("alpha\x00"))
 	vs.daylightUniform = gl.GetUniformLocation(vs.program, gl.Str("daylight\x00"))
 	vs.selectModeUniform = gl.GetUniformLocation(vs.program, gl.Str("selectMode\x00"))
+	vs.variantEnabledUniform = gl.GetUniformLocation(vs.program, gl.Str("variantEnabled\x00"))
+	vs.variantHsvUniform = gl.GetUniformLocation(vs.program, gl.Str("variantHsv\x00"))
+	vs.variantRemapCountUniform = gl.GetUniformLocation(vs.program, gl.Str("variantRemapCount\x00"))
+	vs.variantRemapFromUniform = gl.GetUniformLocation(vs.program, gl.Str("variantRemapFrom\x00"))
+	vs.variantRemapToUniform = gl.GetUniformLocation(vs.program, gl.Str("variantRemapTo\x00"))
+	vs.variantToleranceUniform = gl.GetUniformLocation(vs.program, gl.Str("variantTolerance\x00"))
+	vs.lightCountUniform = gl.GetUniformLocation(vs.program, gl.Str("lightCount\x00"))
+	vs.lightPosUniform = gl.GetUniformLocation(vs.program, gl.Str("lightPos\x00"))
+	vs.lightColorUniform = gl.GetUniformLocation(vs.program, gl.Str("lightColor\x00"))
+	vs.lightRadiusUniform = gl.GetUniformLocation(vs.program, gl.Str("lightRadius\x00"))
+	vs.swayAmountUniform = gl.GetUniformLocation(vs.program, gl.Str("swayAmount\x00"))
+	vs.fogUniform = gl.GetUniformLocation(vs.program, gl.Str("fog\x00"))
+	vs.flashUniform = gl.GetUniformLocation(vs.program, gl.Str("flash\x00"))
 	gl.BindFragDataLocation(vs.program, 0, gl.Str("outputColor\x00"))
 	vs.vertAttrib = uint32(gl.GetAttribLocation(vs.program, gl.Str("vert\x00")))
 	vs.texCoordAttrib = uint32(gl.GetAttribLocation(vs.program, gl.Str("vertTexCoord\x00")))
@@ -135,26 +294,29 @@ uniform mat4 camera;
 uniform mat4 model;
 uniform float textureOffset;
 uniform vec3 viewScroll;
-uniform vec2 modelScroll;
+uniform vec3 modelScroll;
 uniform float time;
 uniform float height;
 uniform int swayEnabled;
+uniform float swayAmount;
 uniform int bobEnabled;
 uniform int breatheEnabled;
 uniform int uniqueOffset;
 in vec3 vert;
 in vec2 vertTexCoord;
 out vec2 fragTexCoord;
+out vec3 fragPos;
+// effect
 void main() {
     fragTexCoord = vec2(vertTexCoord.x + textureOffset, vertTexCoord.y);
 
 	float swayX = 0;
 	if(swayEnabled == 1) {
-		swayX = (vert.z / height) * sin(time + uniqueOffset) / 10.0;
+		swayX = (vert.z / height) * sin(time + uniqueOffset) * swayAmount;
 	}
 	float swayY = 0;
 	if(swayEnabled == 1) {
-		swayY = (vert.z / height) * cos(time + uniqueOffset) / 10.0;
+		swayY = (vert.z / height) * cos(time + uniqueOffset) * swayAmount;
 	}
 	float bobZ = 0;
 	if(bobEnabled == 1) {
@@ -163,9 +325,13 @@ void main() {
 	if(breatheEnabled == 1) {
 		bobZ = (vert.z / height) * cos((time + uniqueOffset) * 2.5) / 20.0;
 	}	
+	vec3 pos = vert + vertexEffect(vert);
 	float offsX = modelScroll.x - viewScroll.x + swayX;
 	float offsY = modelScroll.y - viewScroll.y + swayY;
-	float offsZ = bobZ - viewScroll.z;
+	float offsZ = modelScroll.z + bobZ - viewScroll.z;
+
+	// position relative to the center of the view, for lighting
+	fragPos = vec3(model[3][0] + modelScroll.x + swayX, model[3][1] + modelScroll.y + swayY, model[3][2] + modelScroll.z + bobZ) + pos;
 
 	// matrix constructor is in column first order
 	mat4 modelScroll = mat4(
@@ -174,7 +340,7 @@ void main() {
 		0.0, 0.0, 1.0, 0.0,
 		model[3][0] + offsX, model[3][1] + offsY, model[3][2] + offsZ, 1.0
 	);
-    gl_Position = projection * camera * modelScroll * vec4(vert, 1);
+    gl_Position = projection * camera * modelScroll * vec4(pos, 1);
 }
 ` + "\x00"
 
@@ -182,16 +348,80 @@ var fragmentShader = `
 #version 330
 uniform sampler2D tex;
 uniform float alphaMin;
+uniform float alpha;
 uniform vec4 daylight;
 uniform vec3 selectMode;
+uniform int variantEnabled;
+uniform vec3 variantHsv;
+uniform int variantRemapCount;
+uniform vec3 variantRemapFrom[` + fmt.Sprint(shapes.MAX_REMAP) + `];
+uniform vec3 variantRemapTo[` + fmt.Sprint(shapes.MAX_REMAP) + `];
+uniform float variantTolerance;
+uniform int lightCount;
+uniform vec3 lightPos[` + fmt.Sprint(MAX_LIGHTS) + `];
+uniform vec3 lightColor[` + fmt.Sprint(MAX_LIGHTS) + `];
+uniform float lightRadius[` + fmt.Sprint(MAX_LIGHTS) + `];
+uniform float fog;
+uniform float flash;
+uniform float time;
 in vec2 fragTexCoord;
+in vec3 fragPos;
 layout(location = 0) out vec4 outputColor;
+
+vec3 rgb2hsv(vec3 c) {
+	vec4 K = vec4(0.0, -1.0 / 3.0, 2.0 / 3.0, -1.0);
+	vec4 p = mix(vec4(c.bg, K.wz), vec4(c.gb, K.xy), step(c.b, c.g));
+	vec4 q = mix(vec4(p.xyw, c.r), vec4(c.r, p.yzx), step(p.x, c.r));
+	float d = q.x - min(q.w, q.y);
+	float e = 1.0e-10;
+	return vec3(abs(q.z + (q.w - q.y) / (6.0 * d + e)), d / (q.x + e), q.x);
+}
+
+vec3 hsv2rgb(vec3 c) {
+	vec4 K = vec4(1.0, 2.0 / 3.0, 1.0 / 3.0, 3.0);
+	vec3 p = abs(fract(c.xxx + K.xyz) * 6.0 - K.www);
+	return c.z * mix(K.xxx, clamp(p - K.xxx, 0.0, 1.0), c.y);
+}
+
+vec3 applyVariant(vec3 c) {
+	for (int i = 0; i < variantRemapCount; i++) {
+		if (distance(c, variantRemapFrom[i]) <= variantTolerance) {
+			c = variantRemapTo[i];
+			break;
+		}
+	}
+	if (variantHsv != vec3(0.0)) {
+		vec3 hsv = rgb2hsv(c);
+		hsv.x = fract(hsv.x + variantHsv.x);
+		hsv.yz = clamp(hsv.yz + variantHsv.yz, 0.0, 1.0);
+		c = hsv2rgb(hsv);
+	}
+	return c;
+}
+
+// effect
 void main() {
 	vec4 val = texture(tex, fragTexCoord);
 	if (val.a < alphaMin) {
 		discard;
 	}
-	outputColor = val * daylight;
+	if (variantEnabled == 1) {
+		val.rgb = applyVariant(val.rgb);
+	}
+	val = fragmentEffect(val);
+	vec3 light = daylight.rgb;
+	for (int i = 0; i < lightCount; i++) {
+		float a = clamp(1.0 - distance(fragPos, lightPos[i]) / lightRadius[i], 0.0, 1.0);
+		light += lightColor[i] * a * a;
+	}
+	light += vec3(flash);
+	vec3 c = val.rgb * min(light, vec3(1.0));
+	if (fog > 0.0) {
+		// thicker away from the center of the view
+		float f = fog * clamp(0.35 + length(fragPos.xy) / ` + fmt.Sprint(DRAW_SIZE/2) + `.0, 0.0, 1.0);
+		c = mix(c, vec3(0.7, 0.7, 0.75) * daylight.rgb, f);
+	}
+	outputColor = vec4(c, val.a * daylight.a * alpha);
 }
 ` + "\x00"
 
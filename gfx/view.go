@@ -1,40 +1,40 @@
 package gfx
 
 import (
-	"fmt"
 	"math"
 
 	"github.com/go-gl/gl/all-core/gl"
 	"github.com/go-gl/mathgl/mgl32"
 	"github.com/uzudil/isongn/shapes"
+	"github.com/uzudil/isongn/spatial"
 	"github.com/uzudil/isongn/world"
 )
 
 const (
-	viewSize    = 10
-	SIZE        = 96
-	DRAW_SIZE   = 48
-	SEARCH_SIZE = 16
+	viewSize  = 10
+	SIZE      = spatial.SIZE
+	DRAW_SIZE = 48
+	// falling shapes accelerate by this much (units/sec^2)
+	FALL_ACCEL = 40
 )
 
 // BlockPos is a displayed Shape at a location
 type BlockPos struct {
-	model                  mgl32.Mat4
-	x, y, z                int
-	worldX, worldY, worldZ int
-	pos                    *world.SectionPosition
-	box                    BoundingBox
-	block                  *Block
-	dir                    shapes.Direction
-	animationTimer         float64
-	animationType          int
-	animationStep          int
-	ScrollOffset           [2]float32
-	pathNode               PathNode
-	selectColor            [3]float32
+	spatial.Cell
+	model          mgl32.Mat4
+	block          *Block
+	dir            shapes.Direction
+	animationTimer float64
+	animationType  int
+	animationStep  int
+	ScrollOffset   [2]float32
+	fallOffset     float32
+	fallSpeed      float32
+	selectColor    [3]float32
 }
 
 type View struct {
+	*spatial.Grid
 	width, height      int
 	Loader             *world.Loader
 	projection, camera mgl32.Mat4
@@ -50,9 +50,15 @@ type View struct {
 	maxZ               int
 	underShape         *shapes.Shape
 	daylight           [4]float32
-	context            ViewContext
 	lastClick          [3]int
 	DidClick           bool
+	lights             LightState
+	Weather            *Weather
+	particles          ParticleState
+	Camera             Camera
+	cutaway            CutawayState
+	customShaders      map[string]*CustomShader
+	customShaderList   []*CustomShader
 }
 
 func getProjection(zoom float32, shear [3]float32) mgl32.Mat4 {
@@ -80,7 +86,12 @@ func InitView(zoom float64, camera, shear [3]float32, loader *world.Loader) *Vie
 		daylight:  [4]float32{1, 1, 1, 1},
 		lastClick: [3]int{-1, -1, -1},
 	}
-	view.context.pathThroughShapes = map[*shapes.Shape]bool{}
+	view.lights.placed = map[int]*PlacedLight{}
+	view.Weather = NewWeather(nil)
+	view.particles.emitters = map[int]*Emitter{}
+	view.particles.uiTextures = map[string]*Texture{}
+	view.cutaway.faded = map[[3]int]float32{}
+	view.customShaders = map[string]*CustomShader{}
 	view.projection = getProjection(float32(view.zoom), view.shear)
 
 	// coordinate system: Z is up
@@ -94,14 +105,11 @@ func InitView(zoom float64, camera, shear [3]float32, loader *world.Loader) *Vie
 	// create a block for each shape
 	view.blocks = view.initBlocks()
 
-	// the blockpos array
-	for x := 0; x < SIZE; x++ {
-		for y := 0; y < SIZE; y++ {
-			for z := 0; z < world.SECTION_Z_SIZE; z++ {
-				view.blockPos[x][y][z] = newBlockPos(x, y, z)
-			}
-		}
-	}
+	// the blockpos array, shared with the collision grid
+	view.Grid = spatial.NewGrid(loader, loader.Nav, view, func(x, y, z int) *spatial.Cell {
+		view.blockPos[x][y][z] = newBlockPos(x, y, z)
+		return &view.blockPos[x][y][z].Cell
+	})
 
 	view.Cursor = newBlockPos(SIZE/2, SIZE/2, 0)
 
@@ -117,9 +125,7 @@ func newBlockPos(x, y, z int) *BlockPos {
 	model.Set(2, 3, float32(z))
 
 	return &BlockPos{
-		x:           x,
-		y:           y,
-		z:           z,
+		Cell:        spatial.Cell{X: x, Y: y, Z: z},
 		model:       model,
 		selectColor: [3]float32{float32(x) / 255, float32(y) / 255, float32(z) / 255},
 	}
@@ -150,42 +156,34 @@ func (view *View) SetUnderShape(shape *shapes.Shape) {
 }
 
 func (view *View) Load() {
-	// load
 	view.traverse(func(x, y, z int) {
-		worldX, worldY, worldZ := view.toWorldPos(x, y, z)
 		blockPos := view.blockPos[x][y][z]
-
-		// reset
 		blockPos.ScrollOffset[0] = 0
 		blockPos.ScrollOffset[1] = 0
-		blockPos.worldX = worldX
-		blockPos.worldY = worldY
-		blockPos.worldZ = worldZ
-
-		view.setPos(blockPos, view.Loader.GetPos(worldX, worldY, worldZ))
+		blockPos.fallOffset = 0
+	})
+	view.Grid.Load()
+	view.traverse(func(x, y, z int) {
+		view.CellChanged(&view.blockPos[x][y][z].Cell)
 	})
 }
 
-func (view *View) setPos(blockPos *BlockPos, sectionPos *world.SectionPosition) {
-	blockPos.pos = sectionPos
-	if sectionPos.Block > 0 {
-		block := view.blocks[sectionPos.Block-1]
-		blockPos.model.Set(0, 3, float32(blockPos.x-SIZE/2)+block.shape.Offset[0])
-		blockPos.model.Set(1, 3, float32(blockPos.y-SIZE/2)+block.shape.Offset[1])
-		blockPos.model.Set(2, 3, float32(blockPos.z)+block.shape.Offset[2])
-		blockPos.box.Set(
-			blockPos.x, blockPos.y, blockPos.z,
-			int(block.sizeX), int(block.sizeY), int(block.sizeZ),
-		)
+// CellChanged moves the model of a blockPos to its shape's offset
+func (view *View) CellChanged(cell *spatial.Cell) {
+	blockPos := view.blockPos[cell.X][cell.Y][cell.Z]
+	if cell.Pos.Block > 0 {
+		block := view.blocks[cell.Pos.Block-1]
+		blockPos.model.Set(0, 3, float32(cell.X-SIZE/2)+block.shape.Offset[0])
+		blockPos.model.Set(1, 3, float32(cell.Y-SIZE/2)+block.shape.Offset[1])
+		blockPos.model.Set(2, 3, float32(cell.Z)+block.shape.Offset[2])
 	}
 }
 
-func (view *View) toWorldPos(viewX, viewY, viewZ int) (int, int, int) {
-	return viewX + (view.Loader.X - SIZE/2), viewY + (view.Loader.Y - SIZE/2), viewZ
-}
-
-func (view *View) isValidViewPos(viewX, viewY, viewZ int) bool {
-	return !(viewX < 0 || viewX >= SIZE || viewY < 0 || viewY >= SIZE || viewZ < 0 || viewZ >= world.SECTION_Z_SIZE)
+// CellFell starts the fall animation of a shape that landed distance below where it was
+func (view *View) CellFell(cell *spatial.Cell, distance int) {
+	blockPos := view.blockPos[cell.X][cell.Y][cell.Z]
+	blockPos.fallOffset = float32(distance)
+	blockPos.fallSpeed = 0
 }
 
 func (view *View) isVisibleViewPos(viewX, viewY, viewZ int) bool {
@@ -194,14 +192,8 @@ func (view *View) isVisibleViewPos(viewX, viewY, viewZ int) bool {
 		viewZ >= 0
 }
 
-func (view *View) toViewPos(worldX, worldY, worldZ int) (int, int, int, bool) {
-	viewX := worldX - (view.Loader.X - SIZE/2)
-	viewY := worldY - (view.Loader.Y - SIZE/2)
-	return viewX, viewY, worldZ, view.isValidViewPos(viewX, viewY, worldZ)
-}
-
 func (view *View) toScreenPos(worldX, worldY, worldZ int, viewWidth, viewHeight int) (int, int, bool) {
-	if viewX, viewY, viewZ, ok := view.toViewPos(worldX, worldY, worldZ); ok {
+	if viewX, viewY, viewZ, ok := view.ToViewPos(worldX, worldY, worldZ); ok {
 		pt := mgl32.Vec4{
 			float32(viewX-SIZE/2) - view.ScrollOffset[0],
 			float32(viewY-SIZE/2) - view.ScrollOffset[1],
@@ -221,247 +213,19 @@ func (view *View) toScreenPos(worldX, worldY, worldZ int, viewWidth, viewHeight
 	return 0, 0, false
 }
 
-func (view *View) InView(worldX, worldY, worldZ int) bool {
-	_, _, _, validPos := view.toViewPos(worldX, worldY, worldZ)
-	return validPos
-}
-
-func (view *View) search(viewX, viewY, viewZ int, fx func(*BlockPos) bool) {
-	for x := 0; x < SEARCH_SIZE; x++ {
-		for y := 0; y < SEARCH_SIZE; y++ {
-			for z := 0; z < SEARCH_SIZE; z++ {
-				vx := viewX - x
-				vy := viewY - y
-				vz := viewZ - z
-				if view.isValidViewPos(vx, vy, vz) {
-					bp := view.blockPos[vx][vy][vz]
-					if bp.pos.Block > 0 && fx(bp) {
-						return
-					}
-				}
-			}
-		}
-	}
-}
-
 func (view *View) getShapeExact(viewX, viewY, viewZ int) *BlockPos {
-	if view.isValidViewPos(viewX, viewY, viewZ) {
+	if view.IsValidViewPos(viewX, viewY, viewZ) {
 		return view.blockPos[viewX][viewY][viewZ]
 	}
 	return nil
 }
 
-func (view *View) getShapeAt(viewX, viewY, viewZ int) *BlockPos {
-	var res *BlockPos
-	view.search(viewX, viewY, viewZ, func(bp *BlockPos) bool {
-		if bp.box.isInside(viewX, viewY, viewZ) {
-			res = bp
-			return true
-		}
-		return false
-	})
-	return res
-}
-
-func (view *View) GetShape(worldX, worldY, worldZ int) (int, int, int, int, bool) {
-	viewX, viewY, viewZ, validPos := view.toViewPos(worldX, worldY, worldZ)
-	if !validPos {
-		return 0, 0, 0, 0, false
-	}
-	b := view.getShapeAt(viewX, viewY, viewZ)
-	if b == nil || b.pos.Block == 0 {
-		return 0, 0, 0, 0, false
-	}
-	originWorldX, originWorldY, originWorldZ := view.toWorldPos(b.x, b.y, b.z)
-	return b.pos.Block - 1, originWorldX, originWorldY, originWorldZ, true
-}
-
-func (view *View) GetBlocker(toWorldX, toWorldY, toWorldZ int) *BlockPos {
-	src := view.context.start
-	if src.pos.Block == 0 {
-		fmt.Printf("WARN: View.GetBlocker src position empty %d,%d,%d\n", src.x, src.y, src.z)
-		return nil
-	}
-
-	toViewX, toViewY, toViewZ, validPos := view.toViewPos(toWorldX, toWorldY, toWorldZ)
-	if !validPos {
-		print("WARN: View.GetBlocker dest position invalid\n")
-		return nil
-	}
-
-	return view.getBlockerAt(toViewX, toViewY, toViewZ, &src.box, src)
-}
-
-func (view *View) getBlockerAt(toViewX, toViewY, toViewZ int, box *BoundingBox, src *BlockPos) *BlockPos {
-	oldViewX := box.X
-	oldViewY := box.Y
-	oldViewZ := box.Z
-	// fmt.Printf("src=%d,%d dest=%d,%d\n", src.x, src.y, toViewX, toViewY)
-	box.SetPos(toViewX, toViewY, toViewZ)
-
-	var blocker *BlockPos
-	view.search(toViewX+box.W, toViewY+box.H, toViewZ+box.D, func(bp *BlockPos) bool {
-		pathThrough := false
-		if view.context.isPathing {
-			if view.context.usePathThrough {
-				_, pathThrough = view.context.pathThroughShapes[shapes.Shapes[bp.pos.Block-1]]
-			}
-			if bp == view.context.end {
-				pathThrough = true
-			}
-		}
-		if !pathThrough && bp != src && bp.box.intersect(box) {
-			blocker = bp
-			return true
-		}
-		return false
-	})
-	box.SetPos(oldViewX, oldViewY, oldViewZ)
-	return blocker
-}
-
-func (view *View) IsEmpty(toWorldX, toWorldY, toWorldZ int, shape *shapes.Shape) bool {
-	viewX, viewY, viewZ, validPos := view.toViewPos(toWorldX, toWorldY, toWorldZ)
-	if !validPos {
-		return false
-	}
-	box := &BoundingBox{0, 0, 0, int(shape.Size[0]), int(shape.Size[1]), int(shape.Size[2])}
-	return view.getBlockerAt(viewX, viewY, viewZ, box, nil) == nil
-}
-
 func (view *View) FindTop(worldX, worldY int, shape *shapes.Shape) int {
-	maxZ := 0
-	viewX, viewY, _, validPos := view.toViewPos(worldX, worldY, maxZ)
-	if validPos {
-		box := &BoundingBox{0, 0, 0, int(shape.Size[0]), int(shape.Size[1]), int(shape.Size[2])}
-		for z := view.maxZ - 1; z >= 0; z-- {
-			box.SetPos(viewX, viewY, z)
-			view.search(viewX+box.W, viewY+box.H, z+box.D, func(bp *BlockPos) bool {
-				if bp.box.intersect(box) && bp.z < view.maxZ && z+1 > maxZ {
-					maxZ = z + 1
-				}
-				return false
-			})
-		}
-	}
-	return maxZ
-}
-
-// Move a shape from (worldX, worldY, worldZ) to a new position of (newWorldX, newWorldY).
-// Returns the new Z value, or -1 if the shape won't fit.
-func (view *View) MoveShape(worldX, worldY, worldZ, newWorldX, newWorldY int, isFlying bool) int {
-	newViewX, newViewY, _, validPos := view.toViewPos(newWorldX, newWorldY, 0)
-	if !validPos {
-		return -1
-	}
-
-	startViewX, startViewY, startViewZ, validPos := view.toViewPos(worldX, worldY, worldZ)
-	if !validPos {
-		return -1
-	}
-
-	// figure out the new Z
-	view.context.isPathing = false
-	view.context.isFlying = isFlying
-	view.context.start = view.blockPos[startViewX][startViewY][startViewZ]
-	newPos := view.tryMove(newViewX, newViewY, worldZ)
-
-	// move
-	if newPos != nil {
-		blockPos, shapeIndex := view.EraseShapeExact(worldX, worldY, worldZ)
-		if blockPos != nil {
-			view.SetShape(newWorldX, newWorldY, newPos.z, shapeIndex)
-		}
-		return newPos.z
-	}
-	return -1
-}
-
-func (view *View) tryMove(newViewX, newViewY, newViewZ int) *BlockPos {
-	// can we drop down here? (check this before the same-z move)
-	z := newViewZ
-	var standingOn *BlockPos
-	for z > 0 {
-		standingOn = view.getBlockerWithCache(view.blockPos[newViewX][newViewY][z-1])
-		if standingOn != nil {
-			break
-		}
-		z--
-	}
-	if !view.context.isFlying && standingOn != nil && shapes.Shapes[standingOn.pos.Block-1].NoSupport {
-		return nil
-	}
-	if z < newViewZ {
-		return view.blockPos[newViewX][newViewY][z]
-	}
-
-	// same z move
-	newNode := view.blockPos[newViewX][newViewY][newViewZ]
-	if view.getBlockerWithCache(newNode) == nil {
-		return newNode
-	}
-
-	// step up?
-	newNode = view.blockPos[newViewX][newViewY][newViewZ+1]
-	if view.getBlockerWithCache(newNode) == nil {
-		return newNode
-	}
-	return nil
-}
-
-func (view *View) getBlockerWithCache(node *BlockPos) *BlockPos {
-	if view.context.isPathing {
-		if !node.pathNode.fitCalled {
-			node.pathNode.fitCalled = true
-			node.pathNode.blocker = view.GetBlocker(node.worldX, node.worldY, node.worldZ)
-		}
-		return node.pathNode.blocker
-	} else {
-		return view.GetBlocker(node.worldX, node.worldY, node.worldZ)
-	}
-}
-
-func (view *View) SetShape(worldX, worldY, worldZ int, shapeIndex int) *BlockPos {
-	view.Loader.SetShape(worldX, worldY, worldZ, shapeIndex)
-	viewX, viewY, viewZ, validPos := view.toViewPos(worldX, worldY, worldZ)
-	if validPos {
-		bp := view.blockPos[viewX][viewY][viewZ]
-		view.setPos(bp, view.Loader.GetPos(worldX, worldY, worldZ))
-		return bp
-	}
-	return nil
-}
-
-func (view *View) EraseShapeExact(worldX, worldY, worldZ int) (*BlockPos, int) {
-	viewX, viewY, viewZ, validPos := view.toViewPos(worldX, worldY, worldZ)
-	if validPos {
-		blockPos := view.blockPos[viewX][viewY][viewZ]
-		if blockPos.pos.Block > 0 {
-			shapeIndex := blockPos.pos.Block - 1
-			view.Loader.EraseShape(worldX, worldY, worldZ)
-			return blockPos, shapeIndex
-		}
-	}
-	return nil, 0
-}
-
-func (view *View) EraseShape(worldX, worldY, worldZ int) (*BlockPos, int) {
-	if shapeIndex, ox, oy, oz, hasShape := view.GetShape(worldX, worldY, worldZ); hasShape {
-		view.Loader.EraseShape(ox, oy, oz)
-		viewX, viewY, viewZ, validPos := view.toViewPos(worldX, worldY, worldZ)
-		if validPos {
-			return view.blockPos[viewX][viewY][viewZ], shapeIndex
-		}
-	}
-
-	// sometimes this is called for a shape (creature) no longer in view
-	// assume the position is its origin and remove it from the sector
-	view.Loader.EraseShape(worldX, worldY, worldZ)
-	return nil, 0
+	return view.Grid.FindTop(worldX, worldY, shape, view.maxZ)
 }
 
 func (view *View) GetBlockPos(worldX, worldY, worldZ int) *BlockPos {
-	viewX, viewY, viewZ, validPos := view.toViewPos(worldX, worldY, worldZ)
+	viewX, viewY, viewZ, validPos := view.ToViewPos(worldX, worldY, worldZ)
 	if validPos {
 		return view.blockPos[viewX][viewY][viewZ]
 	}
@@ -527,17 +291,17 @@ func (view *View) Scroll(dx, dy, dz float32) {
 }
 
 func (view *View) isVisible(blockPos *BlockPos) bool {
-	if blockPos.pos != nil {
+	if blockPos.Pos != nil {
 		// is it below the max Z?
-		zOk := blockPos.z < view.maxZ
+		zOk := blockPos.Z < view.maxZ
 		if !view.Loader.IsEditorMode() {
 			if view.underShape != nil && zOk {
 				// if it's below the max and undershape is set: only display if under (ie. dungeon)
-				return zOk && blockPos.pos.Under > 0 && shapes.Shapes[blockPos.pos.Under-1].Group == view.underShape.Group
+				return zOk && blockPos.Pos.Under > 0 && shapes.Shapes[blockPos.Pos.Under-1].Group == view.underShape.Group
 			}
 			if view.underShape == nil && !zOk {
 				// if above the max and undershape is not set: show mountain tops
-				return blockPos.pos.Block > 0 && shapes.Shapes[blockPos.pos.Block-1].Group > 0
+				return blockPos.Pos.Block > 0 && shapes.Shapes[blockPos.Pos.Block-1].Group > 0
 			}
 		}
 		return zOk
@@ -551,11 +315,16 @@ type DrawState struct {
 	vbo     uint32
 	delta   float64
 	time    float64
+	variant int
 }
 
 var state DrawState = DrawState{}
 
 func (view *View) Draw(delta float64, selectMode bool) {
+	if !selectMode {
+		view.updateCamera(delta)
+		view.updateCutaway()
+	}
 	gl.Enable(gl.DEPTH_TEST)
 	gl.ClearColor(0, 0, 0, 1)
 	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
@@ -566,33 +335,41 @@ func (view *View) Draw(delta float64, selectMode bool) {
 	if selectMode {
 		shader = view.selectShaders
 	}
-	gl.UseProgram(shader.program)
 	gl.BindVertexArray(view.vao)
-	gl.EnableVertexAttribArray(shader.vertAttrib)
-	gl.EnableVertexAttribArray(shader.texCoordAttrib)
-	gl.Uniform3fv(shader.viewScrollUniform, 1, &view.ScrollOffset[0])
-	gl.Uniform4fv(shader.daylightUniform, 1, &view.daylight[0])
 	state.delta = delta
 	state.time += delta
-	state.init = false
+	if !selectMode {
+		view.Weather.checkRegion(view.Loader.GetCenter())
+		view.Weather.update(delta)
+		view.updateParticles(float32(delta))
+		view.setLights()
+	}
+	view.useShader(shader, selectMode)
 	view.traverseForDraw(func(x, y, z int) {
 		blockPos := view.blockPos[x][y][z]
+		if blockPos.fallOffset > 0 && !selectMode {
+			blockPos.incrFall()
+		}
 		if view.isVisible(blockPos) {
-			if blockPos.pos.Block > 0 {
-				blockPos.Draw(view, view.blocks[blockPos.pos.Block-1], -1, shader)
+			if blockPos.Pos.Block > 0 && !view.isCutaway(blockPos, selectMode) {
+				if custom := view.blocks[blockPos.Pos.Block-1].custom; custom != nil {
+					custom.draws = append(custom.draws, blockPos)
+				} else {
+					view.drawShape(blockPos, shader)
+				}
 			}
 
 			if selectMode == false {
 				modelZ := blockPos.model.At(2, 3)
-				for i := range blockPos.pos.Extras {
+				for i := range blockPos.Pos.Extras {
 					// show extras slightly on top of each other
 					blockPos.model.Set(2, 3, modelZ+float32(i)*0.01)
-					blockPos.Draw(view, view.blocks[blockPos.pos.Extras[i]], i, shader)
+					blockPos.Draw(view, view.blocks[blockPos.Pos.Extras[i]], i, shader)
 				}
 
-				if blockPos.pos.Edge > 0 {
+				if blockPos.Pos.Edge > 0 {
 					blockPos.model.Set(2, 3, float32(z)+0.01)
-					blockPos.Draw(view, view.blocks[blockPos.pos.Edge-1], -1, shader)
+					blockPos.Draw(view, view.blocks[blockPos.Pos.Edge-1], -1, shader)
 				}
 				blockPos.model.Set(2, 3, modelZ)
 			}
@@ -601,11 +378,97 @@ func (view *View) Draw(delta float64, selectMode bool) {
 	if view.Cursor.block != nil {
 		view.Cursor.Draw(view, view.Cursor.block, -1, shader)
 	}
+	view.drawCustomShaders(selectMode)
+	if !selectMode {
+		view.drawCutaway(shader)
+		view.drawParticles()
+		view.Weather.draw()
+	}
 }
 
-var ZERO_OFFSET [2]float32
+// use the program and set the uniforms that are the same for every shape in the frame
+func (view *View) useShader(shader *ViewShader, selectMode bool) {
+	gl.UseProgram(shader.program)
+	gl.EnableVertexAttribArray(shader.vertAttrib)
+	gl.EnableVertexAttribArray(shader.texCoordAttrib)
+	viewScroll := view.viewScroll()
+	gl.Uniform3fv(shader.viewScrollUniform, 1, &viewScroll[0])
+	gl.Uniform4fv(shader.daylightUniform, 1, &view.daylight[0])
+	// attribute locations can differ between programs
+	state.init = false
+	state.variant = -1
+	setVariant(shader, 0)
+	if !selectMode {
+		view.lights.upload(shader)
+	}
+	gl.Uniform1f(shader.swayAmountUniform, view.Weather.swayAmount())
+	gl.Uniform1f(shader.fogUniform, view.Weather.Current.Fog)
+	gl.Uniform1f(shader.flashUniform, view.Weather.flash)
+	gl.Uniform1f(shader.alphaUniform, 1)
+}
+
+// draw the shapes with custom shaders, grouped by program
+func (view *View) drawCustomShaders(selectMode bool) {
+	for _, custom := range view.customShaderList {
+		if len(custom.draws) == 0 {
+			continue
+		}
+		shader := custom.shader
+		if selectMode {
+			shader = custom.selectShader
+		}
+		view.useShader(shader, selectMode)
+		for _, blockPos := range custom.draws {
+			view.drawShape(blockPos, shader)
+		}
+		custom.draws = custom.draws[:0]
+	}
+	if selectMode {
+		view.useShader(view.selectShaders, selectMode)
+	} else {
+		view.useShader(view.shaders, selectMode)
+	}
+}
+
+// the program that draws the shape
+func (view *View) shaderFor(blockPos *BlockPos) *ViewShader {
+	if custom := view.blocks[blockPos.Pos.Block-1].custom; custom != nil {
+		return custom.shader
+	}
+	return view.shaders
+}
+
+var ZERO_OFFSET [3]float32
+
+// draw the shape with its variant and layers
+func (view *View) drawShape(blockPos *BlockPos, shader *ViewShader) {
+	if blockPos.Pos.Variant > 0 {
+		setVariant(shader, blockPos.Pos.Variant)
+		blockPos.Draw(view, view.blocks[blockPos.Pos.Block-1], -1, shader)
+		setVariant(shader, 0)
+	} else {
+		blockPos.Draw(view, view.blocks[blockPos.Pos.Block-1], -1, shader)
+	}
+	if len(blockPos.Pos.Layers) > 0 {
+		blockPos.drawLayers(view, shader)
+	}
+}
 
 func (b *BlockPos) Draw(view *View, block *Block, extraIndex int, shader *ViewShader) {
+	b.draw(view, block, extraIndex, shader, true)
+}
+
+// Layers share the base shape's animation, direction and step. They are drawn at
+// the same depth, so let them pass the depth test against the base shape.
+func (b *BlockPos) drawLayers(view *View, shader *ViewShader) {
+	gl.DepthFunc(gl.LEQUAL)
+	for _, layer := range b.Pos.Layers {
+		b.draw(view, view.blocks[layer], -1, shader, false)
+	}
+	gl.DepthFunc(gl.LESS)
+}
+
+func (b *BlockPos) draw(view *View, block *Block, extraIndex int, shader *ViewShader, advance bool) {
 	if !state.init || state.texture != block.texture.texture {
 		gl.BindTexture(gl.TEXTURE_2D, block.texture.texture)
 		state.texture = block.texture.texture
@@ -618,15 +481,18 @@ func (b *BlockPos) Draw(view *View, block *Block, extraIndex int, shader *ViewSh
 	}
 	gl.UniformMatrix4fv(shader.modelUniform, 1, false, &b.model[0])
 	if extraIndex == -1 {
-		gl.Uniform2fv(shader.modelScrollUniform, 1, &b.ScrollOffset[0])
+		gl.Uniform3f(shader.modelScrollUniform, b.ScrollOffset[0], b.ScrollOffset[1], b.fallOffset)
 	} else {
-		gl.Uniform2fv(shader.modelScrollUniform, 1, &ZERO_OFFSET[0])
+		gl.Uniform3fv(shader.modelScrollUniform, 1, &ZERO_OFFSET[0])
 	}
 	gl.Uniform3fv(shader.selectModeUniform, 1, &b.selectColor[0])
 	gl.Uniform1f(shader.alphaMinUniform, block.shape.AlphaMin)
 	gl.Uniform1f(shader.timeUniform, float32(state.time))
 	gl.Uniform1f(shader.heightUniform, block.shape.Size[2])
-	gl.Uniform1i(shader.uniqueOffsetUniform, int32(b.worldX+b.worldY+b.worldZ))
+	gl.Uniform1i(shader.uniqueOffsetUniform, int32(b.WorldX+b.WorldY+b.WorldZ))
+	if shader.params != nil {
+		setShaderParams(shader, block.shape)
+	}
 	if block.shape.SwayEnabled {
 		gl.Uniform1i(shader.swayEnabledUniform, 1)
 	} else {
@@ -646,9 +512,11 @@ func (b *BlockPos) Draw(view *View, block *Block, extraIndex int, shader *ViewSh
 	animated := false
 	if b.dir != shapes.DIR_NONE {
 		if animation, ok := block.shape.Animations[b.animationType]; ok {
-			b.incrAnimationStep(animation)
+			if advance {
+				b.incrAnimationStep(animation)
+			}
 			if steps, ok := animation.Tex[b.dir]; ok {
-				gl.Uniform1f(shader.textureOffsetUniform, steps[b.animationStep].TexOffset[0])
+				gl.Uniform1f(shader.textureOffsetUniform, steps[b.animationStep%len(steps)].TexOffset[0])
 				animated = true
 			}
 		}
@@ -660,6 +528,33 @@ func (b *BlockPos) Draw(view *View, block *Block, extraIndex int, shader *ViewSh
 	state.init = true
 }
 
+// variant is the SectionPosition.Variant value: variant index + 1, or 0 for none
+func setVariant(shader *ViewShader, variant int) {
+	if state.variant == variant {
+		return
+	}
+	state.variant = variant
+	if variant == 0 {
+		gl.Uniform1i(shader.variantEnabledUniform, 0)
+		return
+	}
+	v := shapes.Variants[variant-1]
+	gl.Uniform1i(shader.variantEnabledUniform, 1)
+	gl.Uniform3fv(shader.variantHsvUniform, 1, &v.Hsv[0])
+	gl.Uniform1i(shader.variantRemapCountUniform, int32(v.RemapCount))
+	gl.Uniform3fv(shader.variantRemapFromUniform, shapes.MAX_REMAP, &v.RemapFrom[0][0])
+	gl.Uniform3fv(shader.variantRemapToUniform, shapes.MAX_REMAP, &v.RemapTo[0][0])
+	gl.Uniform1f(shader.variantToleranceUniform, v.Tolerance)
+}
+
+func (b *BlockPos) incrFall() {
+	b.fallSpeed += FALL_ACCEL * float32(state.delta)
+	b.fallOffset -= b.fallSpeed * float32(state.delta)
+	if b.fallOffset < 0 {
+		b.fallOffset = 0
+	}
+}
+
 func (b *BlockPos) incrAnimationStep(animation *shapes.Animation) {
 	b.animationTimer -= state.delta
 	if b.animationTimer <= 0 {
@@ -672,13 +567,9 @@ func (b *BlockPos) incrAnimationStep(animation *shapes.Animation) {
 }
 
 func (view *View) Zoom(zoom float64) {
-	view.zoom = math.Min(math.Max(view.zoom-zoom*0.1, 0.35), 16)
-	// fmt.Printf("zoom:%f\n", view.zoom)
-	view.projection = getProjection(float32(view.zoom), view.shear)
-	gl.UseProgram(view.shaders.program)
-	gl.UniformMatrix4fv(view.shaders.projectionUniform, 1, false, &view.projection[0])
-	gl.UseProgram(view.selectShaders.program)
-	gl.UniformMatrix4fv(view.selectShaders.projectionUniform, 1, false, &view.projection[0])
+	// stop the zoom tween
+	view.Camera.zoomDuration = 0
+	view.SetZoom(view.zoom - zoom*0.1)
 }
 
 func (view *View) SetDaylight(r, g, b, a float32) {
@@ -690,16 +581,16 @@ func (view *View) SetDaylight(r, g, b, a float32) {
 
 func (view *View) GetClosestSurfacePoint(mouseVector mgl32.Vec2, viewX, viewY, viewZ int, windowWidth, windowHeight int) (int, int, int, bool) {
 	screenVector := mgl32.Vec2{}
-	blockPos := view.getShapeAt(viewX, viewY, viewZ)
-	if blockPos != nil && blockPos.pos.Block >= 0 {
-		shape := shapes.Shapes[blockPos.pos.Block-1]
+	blockPos := view.GetShapeAt(viewX, viewY, viewZ)
+	if blockPos != nil && blockPos.Pos.Block >= 0 {
+		shape := shapes.Shapes[blockPos.Pos.Block-1]
 		dist := float64(-1)
-		wx := blockPos.worldX
-		wy := blockPos.worldY
+		wx := blockPos.WorldX
+		wy := blockPos.WorldY
 		wz := viewZ + int(shape.Size[2])
 		for x := 0; x < int(shape.Size[0]); x++ {
 			for y := 0; y < int(shape.Size[1]); y++ {
-				sx, sy, _ := view.toScreenPos(blockPos.worldX+x, blockPos.worldY+y, wz, windowWidth, windowHeight)
+				sx, sy, _ := view.toScreenPos(blockPos.WorldX+x, blockPos.WorldY+y, wz, windowWidth, windowHeight)
 				screenVector[0] = float32(sx)
 				screenVector[1] = float32(sy)
 
@@ -710,8 +601,8 @@ func (view *View) GetClosestSurfacePoint(mouseVector mgl32.Vec2, viewX, viewY, v
 				// fmt.Printf("\tdelta=%d,%d screen=%v vs %v distance=%.2f\n", x, y, screenVector, mouseVector, d)
 				if dist < 0 || d < dist {
 					// fmt.Printf("\t\tcloser!\n")
-					wx = blockPos.worldX + x
-					wy = blockPos.worldY + y
+					wx = blockPos.WorldX + x
+					wy = blockPos.WorldY + y
 					dist = d
 				}
 			}
@@ -0,0 +1,285 @@
+package gfx
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/go-gl/gl/all-core/gl"
+)
+
+const (
+	MAX_PARTICLES = 800
+	// seconds to change weather when entering a new region
+	WEATHER_TRANSITION_DEFAULT = 5
+	// sway amplitude without wind (the old fixed value)
+	SWAY_MIN = 0.1
+	SWAY_MAX = 0.5
+)
+
+// WeatherState values are 0-1 intensities, Lightning is the chance of a flash per second
+type WeatherState struct {
+	Rain, Snow, Fog, Wind, Lightning float32
+}
+
+// NewWeatherState parses a weather definition (missing keys are 0)
+func NewWeatherState(def map[string]interface{}) WeatherState {
+	get := func(key string) float32 {
+		if v, ok := def[key].(float64); ok {
+			return float32(v)
+		}
+		return 0
+	}
+	return WeatherState{
+		Rain:      get("rain"),
+		Snow:      get("snow"),
+		Fog:       get("fog"),
+		Wind:      get("wind"),
+		Lightning: get("lightning"),
+	}
+}
+
+func (ws WeatherState) lerp(to WeatherState, t float32) WeatherState {
+	return WeatherState{
+		Rain:      ws.Rain + (to.Rain-ws.Rain)*t,
+		Snow:      ws.Snow + (to.Snow-ws.Snow)*t,
+		Fog:       ws.Fog + (to.Fog-ws.Fog)*t,
+		Wind:      ws.Wind + (to.Wind-ws.Wind)*t,
+		Lightning: ws.Lightning + (to.Lightning-ws.Lightning)*t,
+	}
+}
+
+// WeatherRegion is the default weather of a rectangle of the world
+type WeatherRegion struct {
+	X, Y, W, H int
+	State      WeatherState
+}
+
+type particle struct {
+	x, y, speed, phase float32
+	snow               bool
+}
+
+type Weather struct {
+	Current          WeatherState
+	from, to         WeatherState
+	transition, time float64
+	defaultState     WeatherState
+	regions          []WeatherRegion
+	region           int
+	regionTransition float64
+	flash            float32
+	particles        []particle
+	vertices         []float32
+	program          uint32
+	vao, vbo         uint32
+	posAttrib        uint32
+	colorUniform     int32
+	pointSizeUniform int32
+	initialized      bool
+}
+
+// NewWeather creates the weather from the "weather" config block: "default" is the weather
+// outside the regions, "regions" is a list of x, y, w, h rectangles with their own weather
+// and "transition" is the seconds it takes to change weather when entering a region.
+func NewWeather(config map[string]interface{}) *Weather {
+	weather := &Weather{region: -2, regionTransition: WEATHER_TRANSITION_DEFAULT}
+	if config == nil {
+		return weather
+	}
+	if def, ok := config["default"].(map[string]interface{}); ok {
+		weather.defaultState = NewWeatherState(def)
+	}
+	if transition, ok := config["transition"].(float64); ok {
+		weather.regionTransition = transition
+	}
+	if regions, ok := config["regions"].([]interface{}); ok {
+		for _, r := range regions {
+			region := r.(map[string]interface{})
+			weather.regions = append(weather.regions, WeatherRegion{
+				X:     int(region["x"].(float64)),
+				Y:     int(region["y"].(float64)),
+				W:     int(region["w"].(float64)),
+				H:     int(region["h"].(float64)),
+				State: NewWeatherState(region),
+			})
+		}
+	}
+	return weather
+}
+
+// Set changes the weather over seconds
+func (weather *Weather) Set(state WeatherState, seconds float64) {
+	weather.from = weather.Current
+	weather.to = state
+	weather.transition = seconds
+	weather.time = 0
+	if seconds <= 0 {
+		weather.Current = state
+	}
+}
+
+// Flash shows a lightning flash now
+func (weather *Weather) Flash() {
+	weather.flash = 1
+}
+
+// switch to the region's default weather when the center of the view enters a new region
+func (weather *Weather) checkRegion(x, y int) {
+	region := -1
+	for i, r := range weather.regions {
+		if x >= r.X && x < r.X+r.W && y >= r.Y && y < r.Y+r.H {
+			region = i
+			break
+		}
+	}
+	if region == weather.region {
+		return
+	}
+	transition := weather.regionTransition
+	if weather.region == -2 {
+		// first frame
+		transition = 0
+	}
+	weather.region = region
+	if region == -1 {
+		weather.Set(weather.defaultState, transition)
+	} else {
+		weather.Set(weather.regions[region].State, transition)
+	}
+}
+
+func (weather *Weather) update(delta float64) {
+	if weather.time < weather.transition {
+		weather.time += delta
+		t := float32(math.Min(weather.time/weather.transition, 1))
+		weather.Current = weather.from.lerp(weather.to, t)
+	}
+
+	// lightning
+	weather.flash -= float32(delta) * 4
+	if weather.flash < 0 {
+		weather.flash = 0
+	}
+	if rand.Float64() < float64(weather.Current.Lightning)*delta {
+		weather.flash = 1
+	}
+
+	// particles are in normalized device coordinates
+	rain := int(weather.Current.Rain * MAX_PARTICLES)
+	snow := int(weather.Current.Snow * MAX_PARTICLES)
+	for len(weather.particles) < rain+snow {
+		weather.particles = append(weather.particles, particle{
+			x:     rand.Float32()*2 - 1,
+			y:     rand.Float32()*2 - 1,
+			speed: 0.5 + rand.Float32()*0.5,
+			phase: rand.Float32() * math.Pi * 2,
+		})
+	}
+	weather.particles = weather.particles[:rain+snow]
+	wind := weather.Current.Wind
+	for i := range weather.particles {
+		p := &weather.particles[i]
+		p.snow = i >= rain
+		if p.snow {
+			p.y -= p.speed * 0.3 * float32(delta)
+			p.x += (wind*0.4 + float32(math.Sin(state.time*2+float64(p.phase)))*0.05) * float32(delta)
+		} else {
+			p.y -= p.speed * 2.5 * float32(delta)
+			p.x += wind * 1.2 * float32(delta)
+		}
+		if p.y < -1 {
+			p.y += 2
+			p.x = rand.Float32()*2 - 1
+		}
+		if p.x < -1 {
+			p.x += 2
+		} else if p.x > 1 {
+			p.x -= 2
+		}
+	}
+}
+
+func (weather *Weather) swayAmount() float32 {
+	return SWAY_MIN + (SWAY_MAX-SWAY_MIN)*weather.Current.Wind
+}
+
+func (weather *Weather) init() {
+	var err error
+	weather.program, err = NewProgram(particleVertexShader, particleFragmentShader)
+	if err != nil {
+		panic(err)
+	}
+	weather.colorUniform = gl.GetUniformLocation(weather.program, gl.Str("color\x00"))
+	weather.pointSizeUniform = gl.GetUniformLocation(weather.program, gl.Str("pointSize\x00"))
+	gl.BindFragDataLocation(weather.program, 0, gl.Str("outputColor\x00"))
+	weather.posAttrib = uint32(gl.GetAttribLocation(weather.program, gl.Str("pos\x00")))
+	gl.GenVertexArrays(1, &weather.vao)
+	gl.GenBuffers(1, &weather.vbo)
+	weather.initialized = true
+}
+
+// draw the precipitation over the view
+func (weather *Weather) draw() {
+	if len(weather.particles) == 0 {
+		return
+	}
+	if !weather.initialized {
+		weather.init()
+	}
+	gl.Disable(gl.DEPTH_TEST)
+	gl.Enable(gl.PROGRAM_POINT_SIZE)
+	gl.UseProgram(weather.program)
+	gl.BindVertexArray(weather.vao)
+	gl.BindBuffer(gl.ARRAY_BUFFER, weather.vbo)
+	gl.EnableVertexAttribArray(weather.posAttrib)
+	gl.VertexAttribPointer(weather.posAttrib, 2, gl.FLOAT, false, 2*4, gl.PtrOffset(0))
+
+	// rain: slanted streaks
+	weather.vertices = weather.vertices[:0]
+	wind := weather.Current.Wind
+	for _, p := range weather.particles {
+		if !p.snow {
+			weather.vertices = append(weather.vertices, p.x, p.y, p.x-wind*0.03, p.y+0.05*p.speed)
+		}
+	}
+	if n := len(weather.vertices) / 2; n > 0 {
+		gl.BufferData(gl.ARRAY_BUFFER, len(weather.vertices)*4, gl.Ptr(weather.vertices), gl.DYNAMIC_DRAW)
+		gl.Uniform4f(weather.colorUniform, 0.6, 0.7, 0.9, 0.5)
+		gl.DrawArrays(gl.LINES, 0, int32(n))
+	}
+
+	// snow: flakes
+	weather.vertices = weather.vertices[:0]
+	for _, p := range weather.particles {
+		if p.snow {
+			weather.vertices = append(weather.vertices, p.x, p.y)
+		}
+	}
+	if n := len(weather.vertices) / 2; n > 0 {
+		gl.BufferData(gl.ARRAY_BUFFER, len(weather.vertices)*4, gl.Ptr(weather.vertices), gl.DYNAMIC_DRAW)
+		gl.Uniform4f(weather.colorUniform, 1, 1, 1, 0.8)
+		gl.Uniform1f(weather.pointSizeUniform, 2)
+		gl.DrawArrays(gl.POINTS, 0, int32(n))
+	}
+	gl.Disable(gl.PROGRAM_POINT_SIZE)
+	gl.Enable(gl.DEPTH_TEST)
+}
+
+var particleVertexShader = `
+#version 330
+uniform float pointSize;
+in vec2 pos;
+void main() {
+	gl_PointSize = pointSize;
+	gl_Position = vec4(pos, 0, 1);
+}
+` + "\x00"
+
+var particleFragmentShader = `
+#version 330
+uniform vec4 color;
+layout(location = 0) out vec4 outputColor;
+void main() {
+	outputColor = color;
+}
+` + "\x00"
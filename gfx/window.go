@@ -0,0 +1,161 @@
+package gfx
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/go-gl/gl/all-core/gl"
+	"github.com/go-gl/glfw/v3.3/glfw"
+)
+
+// How the low-res frame buffer is scaled to the window
+const (
+	// fill the window
+	SCALE_STRETCH = "stretch"
+	// largest size that fits the window and keeps the aspect ratio, with black bars on the sides
+	SCALE_FIT = "fit"
+	// like fit, but only whole multiples of the resolution, so pixels stay square and crisp
+	SCALE_INTEGER = "integer"
+)
+
+const windowSettingsFile = "window.json"
+
+type WindowState struct {
+	scaleMode string
+	// where the frame buffer is drawn in the window (in frame buffer pixels): x, y, width, height
+	viewport [4]int
+	// the window position and size before switching to fullscreen
+	windowed [4]int
+}
+
+func isScaleMode(mode string) bool {
+	return mode == SCALE_STRETCH || mode == SCALE_FIT || mode == SCALE_INTEGER
+}
+
+// the scale mode is "scaleMode" in the runtime config, the user's settings override it
+func (app *App) initWindowState() {
+	app.window.scaleMode = SCALE_STRETCH
+	if runtimeConfig, ok := app.Config.runtime[app.Game.Name()].(map[string]interface{}); ok {
+		if mode, ok := runtimeConfig["scaleMode"].(string); ok {
+			if !isScaleMode(mode) {
+				panic(fmt.Sprintf("Unknown scaleMode: %s", mode))
+			}
+			app.window.scaleMode = mode
+		}
+	}
+	app.updateWindowSize()
+	app.Window.SetFramebufferSizeCallback(func(w *glfw.Window, width, height int) {
+		app.updateWindowSize()
+	})
+
+	settings, err := app.LoadMap(windowSettingsFile)
+	if err != nil {
+		fmt.Printf("Can't load window settings: %v\n", err)
+	} else if settings != nil {
+		if mode, ok := (*settings)["scaleMode"].(string); ok && isScaleMode(mode) {
+			app.window.scaleMode = mode
+			app.updateViewport()
+		}
+		if fullscreen, ok := (*settings)["fullscreen"].(bool); ok && fullscreen {
+			app.SetFullscreen(true)
+		}
+	}
+}
+
+func (app *App) saveWindowSettings() {
+	err := app.SaveMap(windowSettingsFile, map[string]interface{}{
+		"scaleMode":  app.window.scaleMode,
+		"fullscreen": app.IsFullscreen(),
+	})
+	if err != nil {
+		fmt.Printf("Can't save window settings: %v\n", err)
+	}
+}
+
+func (app *App) updateWindowSize() {
+	app.windowWidth, app.windowHeight = app.Window.GetSize()
+	app.pxWidth, app.pxHeight = app.Window.GetFramebufferSize()
+	if app.windowWidth == 0 || app.windowHeight == 0 {
+		// minimized
+		return
+	}
+	app.dpiX = float32(app.pxWidth) / float32(app.windowWidth)
+	app.dpiY = float32(app.pxHeight) / float32(app.windowHeight)
+	app.windowWidthDpi = app.pxWidth
+	app.windowHeightDpi = app.pxHeight
+	app.updateViewport()
+}
+
+func (app *App) updateViewport() {
+	w, h := app.windowWidthDpi, app.windowHeightDpi
+	if app.window.scaleMode == SCALE_STRETCH {
+		app.window.viewport = [4]int{0, 0, w, h}
+		return
+	}
+	scale := math.Min(float64(w)/float64(app.Width), float64(h)/float64(app.Height))
+	if app.window.scaleMode == SCALE_INTEGER && scale >= 1 {
+		scale = math.Floor(scale)
+	}
+	vw := int(float64(app.Width) * scale)
+	vh := int(float64(app.Height) * scale)
+	app.window.viewport = [4]int{(w - vw) / 2, (h - vh) / 2, vw, vh}
+}
+
+// the viewport in window coordinates: x, y from the top left, width, height
+func (app *App) windowViewport() (float32, float32, float32, float32) {
+	v := app.window.viewport
+	return float32(v[0]) / app.dpiX, float32(v[1]) / app.dpiY, float32(v[2]) / app.dpiX, float32(v[3]) / app.dpiY
+}
+
+func (app *App) SetScaleMode(mode string) error {
+	if !isScaleMode(mode) {
+		return fmt.Errorf("unknown scale mode: %s", mode)
+	}
+	app.window.scaleMode = mode
+	app.updateViewport()
+	app.saveWindowSettings()
+	return nil
+}
+
+func (app *App) GetScaleMode() string {
+	return app.window.scaleMode
+}
+
+func (app *App) IsFullscreen() bool {
+	return app.Window.GetMonitor() != nil
+}
+
+// SetFullscreen switches to the primary monitor's resolution, or back to the window
+func (app *App) SetFullscreen(fullscreen bool) {
+	if fullscreen == app.IsFullscreen() {
+		return
+	}
+	if fullscreen {
+		x, y := app.Window.GetPos()
+		w, h := app.Window.GetSize()
+		app.window.windowed = [4]int{x, y, w, h}
+		monitor := glfw.GetPrimaryMonitor()
+		mode := monitor.GetVideoMode()
+		app.Window.SetMonitor(monitor, 0, 0, mode.Width, mode.Height, mode.RefreshRate)
+	} else {
+		w := app.window.windowed
+		app.Window.SetMonitor(nil, w[0], w[1], w[2], w[3], 0)
+	}
+	app.updateWindowSize()
+	app.saveWindowSettings()
+}
+
+// F11 or alt+enter: toggle fullscreen
+func (app *App) windowKeys() {
+	if app.IsFirstDown(glfw.KeyF11) || app.IsFirstDownMod(glfw.KeyEnter, glfw.ModAlt) {
+		app.SetFullscreen(!app.IsFullscreen())
+	}
+}
+
+// clear the window, so the bars around the frame buffer are black
+func (app *App) clearWindow() {
+	gl.BindFramebuffer(gl.FRAMEBUFFER, 0)
+	gl.Viewport(0, 0, int32(app.windowWidthDpi), int32(app.windowHeightDpi))
+	gl.ClearColor(0, 0, 0, 1)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+}
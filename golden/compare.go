@@ -0,0 +1,42 @@
+package golden
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Compare counts the pixels of actual that differ from expected by more than tolerance (0-255) in any
+// color channel. The returned image shows the different pixels in red over a faded copy of expected.
+func Compare(expected, actual image.Image, tolerance int) (int, *image.RGBA, error) {
+	bounds := expected.Bounds()
+	if bounds.Dx() != actual.Bounds().Dx() || bounds.Dy() != actual.Bounds().Dy() {
+		return 0, nil, fmt.Errorf("size mismatch: expected %dx%d, got %dx%d",
+			bounds.Dx(), bounds.Dy(), actual.Bounds().Dx(), actual.Bounds().Dy())
+	}
+	diff := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	count := 0
+	offset := actual.Bounds().Min.Sub(bounds.Min)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			e := color.NRGBAModel.Convert(expected.At(x, y)).(color.NRGBA)
+			a := color.NRGBAModel.Convert(actual.At(x+offset.X, y+offset.Y)).(color.NRGBA)
+			dx, dy := x-bounds.Min.X, y-bounds.Min.Y
+			if channelDiff(e.R, a.R) > tolerance || channelDiff(e.G, a.G) > tolerance ||
+				channelDiff(e.B, a.B) > tolerance || channelDiff(e.A, a.A) > tolerance {
+				count++
+				diff.Set(dx, dy, color.RGBA{255, 0, 0, 255})
+			} else {
+				diff.Set(dx, dy, color.RGBA{e.R / 4, e.G / 4, e.B / 4, 255})
+			}
+		}
+	}
+	return count, diff, nil
+}
+
+func channelDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
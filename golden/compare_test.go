@@ -0,0 +1,52 @@
+package golden
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func solid(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestCompareSame(t *testing.T) {
+	a := solid(4, 4, color.RGBA{10, 20, 30, 255})
+	count, _, err := Compare(a, solid(4, 4, color.RGBA{10, 20, 30, 255}), 0)
+	if err != nil || count != 0 {
+		t.Fatalf("expected no differences, got %d %v", count, err)
+	}
+}
+
+func TestCompareTolerance(t *testing.T) {
+	a := solid(4, 4, color.RGBA{100, 100, 100, 255})
+	b := solid(4, 4, color.RGBA{100, 100, 100, 255})
+	b.Set(1, 1, color.RGBA{105, 100, 100, 255})
+	b.Set(2, 2, color.RGBA{100, 120, 100, 255})
+	count, diff, err := Compare(a, b, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 different pixel, got %d", count)
+	}
+	if diff.RGBAAt(2, 2) != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("expected the different pixel to be marked, got %v", diff.RGBAAt(2, 2))
+	}
+	if diff.RGBAAt(1, 1) == (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("pixel within tolerance should not be marked")
+	}
+}
+
+func TestCompareSize(t *testing.T) {
+	_, _, err := Compare(solid(4, 4, color.RGBA{}), solid(4, 5, color.RGBA{}), 0)
+	if err == nil {
+		t.Fatal("expected a size mismatch error")
+	}
+}
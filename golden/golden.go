@@ -0,0 +1,130 @@
+// Package golden compares rendered views of the world to stored images, so changes to rendering
+// can be checked in CI.
+package golden
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DEFAULT_FRAMES    = 10
+	DEFAULT_TOLERANCE = 8
+)
+
+// Case is a view of the world rendered at a time of day
+type Case struct {
+	Name   string
+	X, Y   int
+	Hour   int
+	Min    int
+	Frames int
+	// max difference per color channel (0-255)
+	Tolerance int
+	// number of pixels allowed to be different
+	MaxPixels int
+}
+
+// LoadCases reads the cases from cases.json in the golden dir: a list of objects with
+// name, x, y, hour, min, frames, tolerance and maxPixels. Only name, x and y are required.
+func LoadCases(dir string) ([]Case, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, "cases.json"))
+	if err != nil {
+		return nil, err
+	}
+	data := []map[string]interface{}{}
+	err = json.Unmarshal(bytes, &data)
+	if err != nil {
+		return nil, err
+	}
+	cases := []Case{}
+	for _, c := range data {
+		getInt := func(key string, value int) int {
+			if v, ok := c[key].(float64); ok {
+				return int(v)
+			}
+			return value
+		}
+		cases = append(cases, Case{
+			Name:      c["name"].(string),
+			X:         int(c["x"].(float64)),
+			Y:         int(c["y"].(float64)),
+			Hour:      getInt("hour", 12),
+			Min:       getInt("min", 0),
+			Frames:    getInt("frames", DEFAULT_FRAMES),
+			Tolerance: getInt("tolerance", DEFAULT_TOLERANCE),
+			MaxPixels: getInt("maxPixels", 0),
+		})
+	}
+	return cases, nil
+}
+
+// Run renders every case with render and compares it to <name>.png in dir. On a mismatch, the rendered image is
+// saved as <name>.actual.png and the differences as <name>.diff.png. If update is true the rendered image becomes
+// the new golden image, otherwise a missing golden image fails the case. Returns the number of failed cases.
+func Run(dir string, cases []Case, update bool, render func(c Case) image.Image) int {
+	failed := 0
+	for _, c := range cases {
+		img := render(c)
+		path := filepath.Join(dir, c.Name+".png")
+		if update {
+			if err := writePng(path, img); err != nil {
+				fmt.Printf("FAIL %s: %v\n", c.Name, err)
+				failed++
+			} else {
+				fmt.Printf("SAVED %s\n", path)
+			}
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			writePng(filepath.Join(dir, c.Name+".actual.png"), img)
+			fmt.Printf("FAIL %s: no golden image, run with -update\n", c.Name)
+			failed++
+			continue
+		}
+		expected, err := readPng(path)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.Name, err)
+			failed++
+			continue
+		}
+		count, diff, err := Compare(expected, img, c.Tolerance)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.Name, err)
+			failed++
+			continue
+		}
+		if count > c.MaxPixels {
+			writePng(filepath.Join(dir, c.Name+".actual.png"), img)
+			writePng(filepath.Join(dir, c.Name+".diff.png"), diff)
+			fmt.Printf("FAIL %s: %d pixels differ (max %d)\n", c.Name, count, c.MaxPixels)
+			failed++
+		} else {
+			fmt.Printf("OK %s\n", c.Name)
+		}
+	}
+	return failed
+}
+
+func readPng(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func writePng(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
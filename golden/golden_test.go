@@ -0,0 +1,28 @@
+package golden
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunMissingGolden(t *testing.T) {
+	dir := t.TempDir()
+	cases := []Case{{Name: "town"}}
+	render := func(c Case) image.Image { return solid(4, 4, color.RGBA{10, 20, 30, 255}) }
+	if failed := Run(dir, cases, false, render); failed != 1 {
+		t.Fatalf("expected a missing golden image to fail, got %d failures", failed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "town.png")); !os.IsNotExist(err) {
+		t.Fatal("expected no golden image to be saved without update")
+	}
+
+	if failed := Run(dir, cases, true, render); failed != 0 {
+		t.Fatalf("expected update to save the golden image, got %d failures", failed)
+	}
+	if failed := Run(dir, cases, false, render); failed != 0 {
+		t.Fatalf("expected the saved golden image to match, got %d failures", failed)
+	}
+}
@@ -8,13 +8,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
 	"github.com/uzudil/isongn/editor"
 	"github.com/uzudil/isongn/gfx"
+	"github.com/uzudil/isongn/golden"
 	"github.com/uzudil/isongn/runner"
 	"github.com/uzudil/isongn/script"
 )
@@ -26,12 +29,14 @@ func init() {
 
 func main() {
 	gameDir := flag.String("game", "game", "Location of the game assets directory")
-	mode := flag.String("mode", "runner", "Game or Editor mode")
+	mode := flag.String("mode", "runner", "Game, Editor or golden image test mode")
 	winWidth := flag.Int("width", 800, "Window width (default: 800)")
 	winHeight := flag.Int("height", 600, "Window height (default: 600)")
 	x := flag.Int("x", 5000, "Editor start X")
 	y := flag.Int("y", 5015, "Editor start Y")
 	fps := flag.Float64("fps", 60, "Frames per second")
+	goldenDir := flag.String("golden", "", "Golden image dir (default: <game>/golden)")
+	update := flag.Bool("update", false, "Save the rendered images as the new golden images")
 	flag.Parse()
 
 	if err := glfw.Init(); err != nil {
@@ -39,6 +44,12 @@ func main() {
 	}
 	defer glfw.Terminate()
 
+	if *mode == "golden" {
+		code := runGolden(*gameDir, *goldenDir, *fps, *update)
+		glfw.Terminate()
+		os.Exit(code)
+	}
+
 	editor := editor.NewEditor(*x, *y)
 	runner := runner.NewRunner()
 	var game gfx.Game
@@ -54,3 +65,24 @@ func main() {
 	app := gfx.NewApp(game, *gameDir, *winWidth, *winHeight, *fps)
 	app.Run()
 }
+
+// render the golden image cases without a window and compare them to the stored images
+func runGolden(gameDir, goldenDir string, fps float64, update bool) int {
+	if goldenDir == "" {
+		goldenDir = filepath.Join(gameDir, "golden")
+	}
+	cases, err := golden.LoadCases(goldenDir)
+	if err != nil {
+		log.Println("failed to load golden cases:", err)
+		return 1
+	}
+	scene := runner.NewScene()
+	app := gfx.NewHeadlessApp(scene, gameDir, fps)
+	failed := golden.Run(goldenDir, cases, update, func(c golden.Case) image.Image {
+		return scene.Render(app, c.X, c.Y, c.Hour, c.Min, c.Frames)
+	})
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,6 +1,11 @@
 package runner
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/uzudil/isongn/util"
+)
 
 type CalendarUpdate interface {
 	MinsChange(mins, hours, day, month, year int)
@@ -60,3 +65,45 @@ func (c *Calendar) AsTimeString() string {
 func ToEpoch(mins, hours, day, month, year int) int {
 	return year*ticksPerYear + month*ticksPerMonth + day*ticksPerDay + hours*ticksPerHour + mins
 }
+
+// Daylight is the light color of each hour of the day
+type Daylight [24][3]float32
+
+// NewDaylight parses the calendar's "daylight" block of hour: [r, g, b], missing hours are white
+func NewDaylight(cal map[string]interface{}) *Daylight {
+	daylight := &Daylight{}
+	for i := 0; i < 24; i++ {
+		daylight[i] = [3]float32{255, 255, 255}
+	}
+	if hours, ok := cal["daylight"].(map[string]interface{}); ok {
+		for k, v := range hours {
+			hour, err := strconv.Atoi(k)
+			if err != nil {
+				fmt.Printf("Error parsing daylight hour: %v\n", err)
+			} else {
+				if hour >= 0 && hour < 24 {
+					rgb := v.([]interface{})
+					r := util.Clamp(float32(rgb[0].(float64)), 0, 255)
+					g := util.Clamp(float32(rgb[1].(float64)), 0, 255)
+					b := util.Clamp(float32(rgb[2].(float64)), 0, 255)
+					daylight[hour] = [3]float32{r, g, b}
+				}
+			}
+		}
+	}
+	return daylight
+}
+
+// At returns the color between hours and the next hour
+func (daylight *Daylight) At(mins, hours int) (float32, float32, float32) {
+	nowColor := daylight[hours]
+	nextHour := hours + 1
+	if nextHour >= 24 {
+		nextHour -= 24
+	}
+	nextColor := daylight[nextHour]
+	percent := float32(mins) / 60.0
+	return util.Linear(nowColor[0], nextColor[0], percent),
+		util.Linear(nowColor[1], nextColor[1], percent),
+		util.Linear(nowColor[2], nextColor[2], percent)
+}
@@ -6,7 +6,6 @@ import (
 	"image/color"
 	"image/draw"
 	"path/filepath"
-	"strconv"
 
 	"github.com/uzudil/bscript/bscript"
 	"github.com/uzudil/isongn/gfx"
@@ -63,26 +62,31 @@ type Runner struct {
 	sectionSaveXArg                                *bscript.Value
 	sectionSaveYArg                                *bscript.Value
 	exitCall                                       *bscript.Variable
+	pathFoundCall                                  *bscript.Variable
+	pathFoundHandleArg                             *bscript.Value
+	pathFoundPathArg                               *bscript.Value
+	shapeLandedCall                                *bscript.Variable
+	shapeLandedNameArg                             *bscript.Value
+	shapeLandedXArg, shapeLandedYArg               *bscript.Value
+	shapeLandedZArg                                *bscript.Value
+	cameraPathDoneCall                             *bscript.Variable
+	cameraPathDoneHandleArg                        *bscript.Value
 	messages                                       map[int]*Message
 	messageIndex                                   int
 	updateOverlay                                  bool
 	Calendar                                       *Calendar
 	positionMessages                               []*PositionMessage
-	daylight                                       [24][3]float32
+	daylight                                       *Daylight
 	lastHour                                       int
 	panels                                         []*NamedPanel
 	panelPos                                       map[string][2]int
 }
 
 func NewRunner() *Runner {
-	daylight := [24][3]float32{}
-	for i := 0; i < 24; i++ {
-		daylight[i] = [3]float32{255, 255, 255}
-	}
 	return &Runner{
 		messages:         map[int]*Message{},
 		positionMessages: []*PositionMessage{},
-		daylight:         daylight,
+		daylight:         NewDaylight(nil),
 		panels:           []*NamedPanel{},
 		panelPos:         map[string][2]int{},
 	}
@@ -99,23 +103,7 @@ func (runner *Runner) Init(app *gfx.App, config map[string]interface{}) {
 			int(cal["year"].(float64)),
 			cal["incrementSpeed"].(float64),
 		)
-
-		if daylight, ok := cal["daylight"].(map[string]interface{}); ok {
-			for k, v := range daylight {
-				hour, err := strconv.Atoi(k)
-				if err != nil {
-					fmt.Printf("Error parsing daylight hour: %v\n", err)
-				} else {
-					if hour >= 0 && hour < 24 {
-						rgb := v.([]interface{})
-						r := util.Clamp(float32(rgb[0].(float64)), 0, 255)
-						g := util.Clamp(float32(rgb[1].(float64)), 0, 255)
-						b := util.Clamp(float32(rgb[2].(float64)), 0, 255)
-						runner.daylight[hour] = [3]float32{r, g, b}
-					}
-				}
-			}
-		}
+		runner.daylight = NewDaylight(cal)
 	} else {
 		runner.Calendar = NewCalendar(0, 9, 1, 5, 1992, 0.1)
 	}
@@ -165,6 +153,18 @@ func (runner *Runner) Init(app *gfx.App, config map[string]interface{}) {
 
 	runner.exitCall = util.NewFunctionCall("exitEvent")
 
+	runner.pathFoundHandleArg = &bscript.Value{Number: &bscript.SignedNumber{}}
+	runner.pathFoundPathArg = &bscript.Value{}
+	runner.pathFoundCall = util.NewFunctionCall("onPathFound", runner.pathFoundHandleArg, runner.pathFoundPathArg)
+
+	runner.shapeLandedNameArg = &bscript.Value{}
+	runner.shapeLandedXArg = &bscript.Value{Number: &bscript.SignedNumber{}}
+	runner.shapeLandedYArg = &bscript.Value{Number: &bscript.SignedNumber{}}
+	runner.shapeLandedZArg = &bscript.Value{Number: &bscript.SignedNumber{}}
+	runner.shapeLandedCall = util.NewFunctionCall("onShapeLanded", runner.shapeLandedNameArg, runner.shapeLandedXArg, runner.shapeLandedYArg, runner.shapeLandedZArg)
+	runner.cameraPathDoneHandleArg = &bscript.Value{Number: &bscript.SignedNumber{}}
+	runner.cameraPathDoneCall = util.NewFunctionCall("onCameraPathDone", runner.cameraPathDoneHandleArg)
+
 	// run the main method
 	_, err = ast.Evaluate(ctx)
 	if err != nil {
@@ -193,6 +193,45 @@ func (runner *Runner) Events(delta float64, fadeDir int, mouseX, mouseY, mouseWo
 	}
 	runner.mouseOnInteractiveArg.Number.Number = n
 	runner.eventsCall.Evaluate(runner.ctx)
+	runner.pathsFound(delta)
+	runner.shapesLanded()
+	runner.cameraPathsDone()
+}
+
+// advance the path requests and call onPathFound(handle, path) for the finished ones
+// path is an array of x,y,z triplets, empty if no path was found
+func (runner *Runner) pathsFound(delta float64) {
+	for _, request := range runner.app.View.AdvancePaths(delta) {
+		r := make([]interface{}, len(request.Steps)*3)
+		for i, node := range request.Steps {
+			r[i*3] = float64(node[0])
+			r[i*3+1] = float64(node[1])
+			r[i*3+2] = float64(node[2])
+		}
+		runner.pathFoundHandleArg.Number.Number = float64(request.Handle)
+		runner.pathFoundPathArg.Array = util.ToBscriptArray(&r)
+		runner.pathFoundCall.Evaluate(runner.ctx)
+	}
+}
+
+// call onShapeLanded(shape, x, y, z) for the shapes that fell since the last frame
+func (runner *Runner) shapesLanded() {
+	for _, landing := range runner.app.View.TakeLandings() {
+		name := shapes.Shapes[landing.ShapeIndex].Name
+		runner.shapeLandedNameArg.String = &name
+		runner.shapeLandedXArg.Number.Number = float64(landing.X)
+		runner.shapeLandedYArg.Number.Number = float64(landing.Y)
+		runner.shapeLandedZArg.Number.Number = float64(landing.Z)
+		runner.shapeLandedCall.Evaluate(runner.ctx)
+	}
+}
+
+// call onCameraPathDone(handle) for the camera paths that ended since the last frame
+func (runner *Runner) cameraPathsDone() {
+	for _, handle := range runner.app.View.TakeCameraPathsDone() {
+		runner.cameraPathDoneHandleArg.Number.Number = float64(handle)
+		runner.cameraPathDoneCall.Evaluate(runner.ctx)
+	}
 }
 
 func (runner *Runner) GetZ() int {
@@ -298,19 +337,8 @@ func (runner *Runner) timeoutMessages(delta float64) {
 }
 
 func (runner *Runner) MinsChange(mins, hours, day, month, year int) {
-	nowColor := runner.daylight[hours]
-	nextHour := hours + 1
-	if nextHour >= 24 {
-		nextHour -= 24
-	}
-	nextColor := runner.daylight[nextHour]
-	percent := float32(mins) / 60.0
-	runner.app.View.SetDaylight(
-		util.Linear(nowColor[0], nextColor[0], percent),
-		util.Linear(nowColor[1], nextColor[1], percent),
-		util.Linear(nowColor[2], nextColor[2], percent),
-		255,
-	)
+	r, g, b := runner.daylight.At(mins, hours)
+	runner.app.View.SetDaylight(r, g, b, 255)
 	time := ToEpoch(mins, hours, day, month, year)
 	if time-runner.lastHour > 60 {
 		runner.lastHour = time
@@ -0,0 +1,68 @@
+package runner
+
+import (
+	"image"
+
+	"github.com/uzudil/isongn/gfx"
+	"github.com/uzudil/isongn/world"
+)
+
+// Scene is a game without scripts or ui, it shows the map as the runner would at a fixed time of
+// day. It's used to render golden images.
+type Scene struct {
+	app      *gfx.App
+	daylight *Daylight
+	mins     int
+	hours    int
+}
+
+func NewScene() *Scene {
+	return &Scene{daylight: NewDaylight(nil)}
+}
+
+func (scene *Scene) Init(app *gfx.App, config map[string]interface{}) {
+	scene.app = app
+	if cal, ok := config["calendar"].(map[string]interface{}); ok {
+		scene.daylight = NewDaylight(cal)
+	}
+}
+
+// Name uses the runner's resolution, fonts and calendar config
+func (scene *Scene) Name() string {
+	return "runner"
+}
+
+func (scene *Scene) Events(delta float64, fadeDir int, mouseX, mouseY, mouseWorldX, mouseWorldY, mouseWorldZ, mouseButtonDown int32, mouseOnInteractive bool) {
+	r, g, b := scene.daylight.At(scene.mins, scene.hours)
+	scene.app.View.SetDaylight(r, g, b, 255)
+}
+
+func (scene *Scene) GetZ() int {
+	return 0
+}
+
+func (scene *Scene) DragFromUi(pixelX, pixelY int) (string, int) {
+	return "", 0
+}
+
+func (scene *Scene) Exit() {}
+
+func (scene *Scene) SectionLoad(x, y int, data map[string]interface{}) {
+}
+
+func (scene *Scene) SectionSave(x, y int) map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (scene *Scene) Loading(working bool) {
+}
+
+// Render moves to the world position and draws frames at the time of day, returns the last frame
+func (scene *Scene) Render(app *gfx.App, x, y, hours, mins, frames int) *image.RGBA {
+	scene.hours = hours
+	scene.mins = mins
+	app.Loader.SetIoMode(world.RUNNER_MODE)
+	app.Loader.MoveTo(x, y)
+	app.View.Load()
+	return app.RenderFrames(frames)
+}
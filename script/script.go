@@ -3,12 +3,15 @@ package script
 import (
 	"fmt"
 	"math"
+	"sort"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
 	"github.com/uzudil/bscript/bscript"
+	"github.com/uzudil/isongn/editor"
 	"github.com/uzudil/isongn/gfx"
 	"github.com/uzudil/isongn/runner"
 	"github.com/uzudil/isongn/shapes"
+	"github.com/uzudil/isongn/spatial"
 )
 
 func getDateTime(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
@@ -188,6 +191,83 @@ func getShapeExtra(ctx *bscript.Context, arg ...interface{}) (interface{}, error
 	return &r, nil
 }
 
+func addLayer(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	name := arg[3].(string)
+	shapeIndex, ok := shapes.Names[name]
+	if !ok {
+		return nil, fmt.Errorf("%s unknown shape: %s", ctx.Pos, name)
+	}
+	app := ctx.App["app"].(*gfx.App)
+	app.Loader.AddLayer(x, y, z, shapeIndex)
+	return nil, nil
+}
+
+func removeLayer(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	name := arg[3].(string)
+	shapeIndex, ok := shapes.Names[name]
+	if !ok {
+		return nil, fmt.Errorf("%s unknown shape: %s", ctx.Pos, name)
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return app.Loader.EraseLayer(x, y, z, shapeIndex), nil
+}
+
+func clearLayers(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	app.Loader.EraseAllLayers(x, y, z)
+	return nil, nil
+}
+
+func getLayers(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	layers := app.Loader.GetLayers(x, y, z)
+	r := make([]interface{}, len(layers))
+	for i, l := range layers {
+		r[i] = shapes.Shapes[l].Name
+	}
+	return &r, nil
+}
+
+func setVariant(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	if name, ok := arg[3].(string); ok {
+		variantIndex, ok := shapes.VariantNames[name]
+		if !ok {
+			return nil, fmt.Errorf("%s unknown variant: %s", ctx.Pos, name)
+		}
+		app.Loader.SetVariant(x, y, z, variantIndex)
+	} else {
+		app.Loader.ClearVariant(x, y, z)
+	}
+	return nil, nil
+}
+
+func getVariant(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	if variantIndex, ok := app.Loader.GetVariant(x, y, z); ok {
+		return shapes.Variants[variantIndex].Name, nil
+	}
+	return nil, nil
+}
+
 func moveShape(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
 	x := int(arg[0].(float64))
 	y := int(arg[1].(float64))
@@ -199,6 +279,337 @@ func moveShape(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
 	return float64(app.View.MoveShape(x, y, z, nx, ny, isFlying)), nil
 }
 
+// moveShapeEx(x, y, z, nx, ny, isFlying, options) returns {z, reason, blocker, blockerPos, pushed}
+func moveShapeEx(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	nx := int(arg[3].(float64))
+	ny := int(arg[4].(float64))
+	isFlying := arg[5].(bool)
+	push := false
+	if len(arg) > 6 {
+		if m, ok := arg[6].(map[string]interface{}); ok {
+			if b, ok := m["push"].(bool); ok {
+				push = b
+			}
+		}
+	}
+	app := ctx.App["app"].(*gfx.App)
+	result := app.View.MoveShapeEx(x, y, z, nx, ny, isFlying, push)
+	ret := map[string]interface{}{
+		"z":      float64(result.Z),
+		"pushed": result.Pushed,
+	}
+	if result.Reason != "" {
+		ret["reason"] = result.Reason
+	}
+	if result.BlockerIndex >= 0 {
+		ret["blocker"] = shapes.Shapes[result.BlockerIndex].Name
+		ret["blockerPos"] = &[]interface{}{float64(result.BlockerX), float64(result.BlockerY), float64(result.BlockerZ)}
+	}
+	return ret, nil
+}
+
+// with gravity on, shapes left without support fall and onShapeLanded(shape, x, y, z) is called
+func setGravity(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.View.SetGravity(arg[0].(bool))
+	return nil, nil
+}
+
+// addLight(x, y, z, [r, g, b], radius, flicker) places a point light, returns a handle for delLight
+func addLight(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := float32(arg[0].(float64))
+	y := float32(arg[1].(float64))
+	z := float32(arg[2].(float64))
+	color, ok := arg[3].(*[]interface{})
+	if !ok || len(*color) < 3 {
+		return nil, fmt.Errorf("%s light color should be [r, g, b]", ctx.Pos)
+	}
+	rgb := [3]float32{}
+	for i := range rgb {
+		c, ok := (*color)[i].(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s light color should be [r, g, b]", ctx.Pos)
+		}
+		rgb[i] = float32(c) / 255
+	}
+	radius := arg[4].(float64)
+	if radius <= 0 {
+		return nil, fmt.Errorf("%s light radius should be positive: %v", ctx.Pos, radius)
+	}
+	light := &shapes.Light{
+		Color:   rgb,
+		Radius:  float32(radius),
+		Flicker: float32(arg[5].(float64)),
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return float64(app.View.AddLight(x, y, z, light)), nil
+}
+
+func delLight(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.View.DelLight(int(arg[0].(float64)))
+	return nil, nil
+}
+
+// setWeather(weather, seconds) changes to weather (a map of rain, snow, fog, wind and lightning) over seconds
+func setWeather(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	weather := arg[0].(map[string]interface{})
+	seconds := arg[1].(float64)
+	app := ctx.App["app"].(*gfx.App)
+	app.View.Weather.Set(gfx.NewWeatherState(weather), seconds)
+	return nil, nil
+}
+
+func getWeather(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	current := app.View.Weather.Current
+	return map[string]interface{}{
+		"rain":      float64(current.Rain),
+		"snow":      float64(current.Snow),
+		"fog":       float64(current.Fog),
+		"wind":      float64(current.Wind),
+		"lightning": float64(current.Lightning),
+	}, nil
+}
+
+func lightningFlash(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.View.Weather.Flash()
+	return nil, nil
+}
+
+// startEmitter(x, y, z, options) starts a particle emitter and returns its handle. Options:
+// sprite (shape or ui image name), rate, lifetime, velocity [x, y, z], spread [x, y, z], gravity,
+// size, sizeEnd, color [r, g, b, a], colorEnd [r, g, b, a] and duration.
+func startEmitter(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := float32(arg[0].(float64))
+	y := float32(arg[1].(float64))
+	z := float32(arg[2].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	config, err := app.View.NewEmitterConfig(arg[3].(map[string]interface{}))
+	if err != nil {
+		return nil, fmt.Errorf("%s %v", ctx.Pos, err)
+	}
+	return float64(app.View.StartEmitter(x, y, z, config)), nil
+}
+
+func moveEmitter(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	handle := int(arg[0].(float64))
+	x := float32(arg[1].(float64))
+	y := float32(arg[2].(float64))
+	z := float32(arg[3].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	app.View.MoveEmitter(handle, x, y, z)
+	return nil, nil
+}
+
+// stop emitting new particles, the existing ones live out their lifetime
+func stopEmitter(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.View.StopEmitter(int(arg[0].(float64)))
+	return nil, nil
+}
+
+func delEmitter(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.View.DelEmitter(int(arg[0].(float64)))
+	return nil, nil
+}
+
+// screenshot(windowSize) saves the next frame as a png, returns the file name
+func screenshot(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	windowSize := false
+	if len(arg) > 0 {
+		windowSize = arg[0].(bool)
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return app.Screenshot(windowSize), nil
+}
+
+// startCapture(windowSize) saves every frame as a png until stopCapture(), returns the dir
+func startCapture(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	windowSize := false
+	if len(arg) > 0 {
+		windowSize = arg[0].(bool)
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return app.StartCapture(windowSize), nil
+}
+
+func stopCapture(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.StopCapture()
+	return nil, nil
+}
+
+func setFullscreen(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.SetFullscreen(arg[0].(bool))
+	return nil, nil
+}
+
+func isFullscreen(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	return app.IsFullscreen(), nil
+}
+
+// setScaleMode(mode) where mode is "stretch", "fit" (letterbox) or "integer" (crisp pixels)
+func setScaleMode(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	if err := app.SetScaleMode(arg[0].(string)); err != nil {
+		return nil, fmt.Errorf("%s %v", ctx.Pos, err)
+	}
+	return nil, nil
+}
+
+func getScaleMode(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	return app.GetScaleMode(), nil
+}
+
+// cameraFollow(x, y, z, options) keeps the shape at x, y, z in view. Options: deadZone (units the shape
+// can move before the camera follows, default 0) and easing (how fast the camera catches up, 0 snaps)
+func cameraFollow(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	deadZone := 0.0
+	easing := 5.0
+	if len(arg) > 3 {
+		options := arg[3].(map[string]interface{})
+		if v, ok := options["deadZone"].(float64); ok {
+			deadZone = v
+		}
+		if v, ok := options["easing"].(float64); ok {
+			easing = v
+		}
+	}
+	app := ctx.App["app"].(*gfx.App)
+	app.View.CameraFollow(x, y, z, float32(deadZone), float32(easing))
+	return nil, nil
+}
+
+// cameraPath([[x, y, z], ...], speed) moves the camera through the points at speed units per second,
+// returns a handle that is passed to onCameraPathDone(handle) at the end
+func cameraPath(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	points := []gfx.CameraPoint{}
+	for _, p := range *(arg[0].(*[]interface{})) {
+		point := *(p.(*[]interface{}))
+		if len(point) < 3 {
+			return nil, fmt.Errorf("%s camera path points should be [x, y, z]", ctx.Pos)
+		}
+		points = append(points, gfx.CameraPoint{float32(point[0].(float64)), float32(point[1].(float64)), float32(point[2].(float64))})
+	}
+	speed := arg[1].(float64)
+	app := ctx.App["app"].(*gfx.App)
+	return float64(app.View.CameraPath(points, float32(speed))), nil
+}
+
+func cameraStop(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.View.CameraStop()
+	return nil, nil
+}
+
+// cameraShake(amplitude, decay): shake the view by amplitude units, decreasing by decay per second
+func cameraShake(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	amplitude := arg[0].(float64)
+	decay := arg[1].(float64)
+	app := ctx.App["app"].(*gfx.App)
+	app.View.CameraShake(float32(amplitude), float32(decay))
+	return nil, nil
+}
+
+// zoomTo(level, seconds)
+func zoomTo(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	level := arg[0].(float64)
+	seconds := 0.0
+	if len(arg) > 1 {
+		seconds = arg[1].(float64)
+	}
+	app := ctx.App["app"].(*gfx.App)
+	app.View.ZoomTo(level, seconds)
+	return nil, nil
+}
+
+func getZoom(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	return app.View.GetZoom(), nil
+}
+
+// setCutaway(x, y, z, options) fades the shapes between the camera and the shape at x, y, z. Options:
+// radius (default 3), alpha of the faded shapes (default 0.3, 0 cuts them away) and groups, the list of
+// shape groups that can fade (default: all)
+func setCutaway(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	radius := 3.0
+	alpha := 0.3
+	groups := []int{}
+	if len(arg) > 3 {
+		options := arg[3].(map[string]interface{})
+		if v, ok := options["radius"].(float64); ok {
+			radius = v
+		}
+		if v, ok := options["alpha"].(float64); ok {
+			alpha = v
+		}
+		if v, ok := options["groups"].(*[]interface{}); ok {
+			for _, group := range *v {
+				groups = append(groups, int(group.(float64)))
+			}
+		}
+	}
+	app := ctx.App["app"].(*gfx.App)
+	app.View.SetCutaway(x, y, z, float32(radius), float32(alpha), groups)
+	return nil, nil
+}
+
+func clearCutaway(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	app := ctx.App["app"].(*gfx.App)
+	app.View.ClearCutaway()
+	return nil, nil
+}
+
+// setPostEffect(name, enabled) turns a post process effect from the config on or off
+func setPostEffect(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	name := arg[0].(string)
+	enabled := arg[1].(bool)
+	app := ctx.App["app"].(*gfx.App)
+	if err := app.Post.SetEnabled(name, enabled); err != nil {
+		return nil, fmt.Errorf("%s %v", ctx.Pos, err)
+	}
+	return nil, nil
+}
+
+// setPostParam(name, param, value) sets a uniform of a post process effect, value is a number or an
+// array with as many numbers as its default. The palette effect's "colors" is an array of [r, g, b].
+func setPostParam(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	name := arg[0].(string)
+	param := arg[1].(string)
+	app := ctx.App["app"].(*gfx.App)
+	if err := app.Post.SetParam(name, param, fromScriptArrays(arg[2])); err != nil {
+		return nil, fmt.Errorf("%s %v", ctx.Pos, err)
+	}
+	return nil, nil
+}
+
+// the script's array pointers as slices (like values parsed from json)
+func fromScriptArrays(value interface{}) interface{} {
+	if a, ok := value.(*[]interface{}); ok {
+		r := make([]interface{}, len(*a))
+		for i, v := range *a {
+			r[i] = fromScriptArrays(v)
+		}
+		return r
+	}
+	return value
+}
+
 func setOffset(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
 	x := int(arg[0].(float64))
 	y := int(arg[1].(float64))
@@ -300,6 +711,78 @@ func getShape(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
 	return nil, nil
 }
 
+func reEdge(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	w := int(arg[2].(float64))
+	h := int(arg[3].(float64))
+	e, ok := ctx.App["editor"].(*editor.Editor)
+	if !ok {
+		return nil, fmt.Errorf("%s reEdge is only available in the editor", ctx.Pos)
+	}
+	e.ReEdge(x, y, w, h)
+	return nil, nil
+}
+
+func getShapeInfo(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	name := arg[0].(string)
+	shapeIndex, ok := shapes.Names[name]
+	if !ok {
+		return nil, nil
+	}
+	shape := shapes.Shapes[shapeIndex]
+	size := []interface{}{float64(shape.Size[0]), float64(shape.Size[1]), float64(shape.Size[2])}
+	flags := map[string]interface{}{
+		"sway":        shape.SwayEnabled,
+		"bob":         shape.BobEnabled,
+		"breathe":     shape.BreatheEnabled,
+		"nosupport":   shape.NoSupport,
+		"extra":       shape.IsExtra,
+		"drag":        shape.IsDraggable,
+		"interactive": shape.IsInteractive,
+	}
+	animationIndexes := []int{}
+	for animationIndex := range shape.Animations {
+		animationIndexes = append(animationIndexes, animationIndex)
+	}
+	sort.Ints(animationIndexes)
+	animations := []interface{}{}
+	for _, animationIndex := range animationIndexes {
+		animations = append(animations, shape.Animations[animationIndex].Name)
+	}
+	properties := map[string]interface{}{}
+	for k, v := range shape.Properties {
+		properties[k] = copyValue(v)
+	}
+	return map[string]interface{}{
+		"name":       shape.Name,
+		"size":       &size,
+		"group":      float64(shape.Group),
+		"flags":      flags,
+		"animations": &animations,
+		"properties": properties,
+	}, nil
+}
+
+// copy a config value so scripts can't modify the shape definition; arrays become script arrays
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		r := make([]interface{}, len(v))
+		for i, e := range v {
+			r[i] = copyValue(e)
+		}
+		return &r
+	}
+	return value
+}
+
 func getPosition(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
 	r := make([]interface{}, 3)
 	app := ctx.App["app"].(*gfx.App)
@@ -406,6 +889,8 @@ func setPathThroughShapes(ctx *bscript.Context, arg ...interface{}) (interface{}
 	return nil, nil
 }
 
+// returns null if there is no path, otherwise the steps as [x,y,z,...]. If options has
+// "withCost": true, it returns a map of the steps and their total cost instead.
 func findPath(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
 	sx := int(arg[0].(float64))
 	sy := int(arg[1].(float64))
@@ -416,19 +901,283 @@ func findPath(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
 	isFlying := arg[6].(bool)
 	dSrc := int(arg[7].(float64))
 	dDst := int(arg[8].(float64))
+	options, err := toPathOptions(ctx, arg, 9, isFlying)
+	if err != nil {
+		return nil, err
+	}
+	withCost := false
+	if len(arg) > 9 {
+		if m, ok := arg[9].(map[string]interface{}); ok {
+			withCost, _ = m["withCost"].(bool)
+		}
+	}
 	app := ctx.App["app"].(*gfx.App)
-	path := app.View.FindPath(sx, sy, sz, ex, ey, ez, isFlying, dSrc, dDst)
+	path, cost := app.View.FindPath(sx, sy, sz, ex, ey, ez, dSrc, dDst, options)
 	if path == nil {
 		return nil, nil
-	} else {
-		r := make([]interface{}, len(path)*3)
-		for i, node := range path {
-			r[i*3] = float64(node[0])
-			r[i*3+1] = float64(node[1])
-			r[i*3+2] = float64(node[2])
+	}
+	if !withCost {
+		return toPathArray(path), nil
+	}
+	return map[string]interface{}{
+		"steps": toPathArray(path),
+		"cost":  cost,
+	}, nil
+}
+
+// like findPath but runs over several frames. Returns a handle for pollPath and cancelPath.
+// If options has "callback": true, onPathFound(handle, path) is called when done.
+func requestPath(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	sx := int(arg[0].(float64))
+	sy := int(arg[1].(float64))
+	sz := int(arg[2].(float64))
+	ex := int(arg[3].(float64))
+	ey := int(arg[4].(float64))
+	ez := int(arg[5].(float64))
+	isFlying := arg[6].(bool)
+	dSrc := int(arg[7].(float64))
+	dDst := int(arg[8].(float64))
+	options, err := toPathOptions(ctx, arg, 9, isFlying)
+	if err != nil {
+		return nil, err
+	}
+	callback := false
+	if len(arg) > 9 {
+		if m, ok := arg[9].(map[string]interface{}); ok {
+			callback, _ = m["callback"].(bool)
 		}
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return float64(app.View.RequestPath(sx, sy, sz, ex, ey, ez, dSrc, dDst, options, callback)), nil
+}
+
+// like requestPath, but the destination can be outside the view. The path goes to the furthest reachable
+// waypoint in view, pollPath also returns the remaining waypoints.
+func requestPathFar(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	sx := int(arg[0].(float64))
+	sy := int(arg[1].(float64))
+	sz := int(arg[2].(float64))
+	ex := int(arg[3].(float64))
+	ey := int(arg[4].(float64))
+	ez := int(arg[5].(float64))
+	isFlying := arg[6].(bool)
+	dSrc := int(arg[7].(float64))
+	dDst := int(arg[8].(float64))
+	options, err := toPathOptions(ctx, arg, 9, isFlying)
+	if err != nil {
+		return nil, err
+	}
+	callback := false
+	if len(arg) > 9 {
+		if m, ok := arg[9].(map[string]interface{}); ok {
+			callback, _ = m["callback"].(bool)
+		}
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return float64(app.View.RequestPathFar(sx, sy, sz, ex, ey, ez, dSrc, dDst, options, callback)), nil
+}
+
+// returns null for an unknown (or expired) handle, otherwise a map of done, steps and cost (and waypoints
+// for requestPathFar)
+func pollPath(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	handle := int(arg[0].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	request := app.View.PollPath(handle)
+	if request == nil {
+		return nil, nil
+	}
+	m := map[string]interface{}{
+		"done": request.Done,
+		"cost": request.Cost,
+	}
+	if request.Done && request.Steps != nil {
+		m["steps"] = toPathArray(request.Steps)
+		if request.Waypoints != nil {
+			m["waypoints"] = toPathArray(request.Waypoints)
+		}
+	}
+	return m, nil
+}
+
+func cancelPath(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	handle := int(arg[0].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	app.View.CancelPath(handle)
+	return nil, nil
+}
+
+// build a flow field toward x,y,z covering radius positions around it, for creatures of size
+// options are the same as for findPath. Returns a handle for flowStep.
+func createFlowField(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	x := int(arg[0].(float64))
+	y := int(arg[1].(float64))
+	z := int(arg[2].(float64))
+	radius := int(arg[3].(float64))
+	size := int(arg[4].(float64))
+	options, err := toPathOptions(ctx, arg, 5, false)
+	if err != nil {
+		return nil, err
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return float64(app.View.CreateFlowField(x, y, z, radius, size, options)), nil
+}
+
+// the next position [x, y, z] toward (or away from, if flee is true) the flow field's target, or null
+func flowStep(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	handle := int(arg[0].(float64))
+	x := int(arg[1].(float64))
+	y := int(arg[2].(float64))
+	z := int(arg[3].(float64))
+	flee := arg[4].(bool)
+	app := ctx.App["app"].(*gfx.App)
+	if step, ok := app.View.FlowStep(handle, x, y, z, flee); ok {
+		r := []interface{}{float64(step[0]), float64(step[1]), float64(step[2])}
 		return &r, nil
 	}
+	return nil, nil
+}
+
+func deleteFlowField(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	handle := int(arg[0].(float64))
+	app := ctx.App["app"].(*gfx.App)
+	app.View.DeleteFlowField(handle)
+	return nil, nil
+}
+
+// returns null if nothing blocks the line from the start to the end position, otherwise a map
+// of the blocking shape's name, origin (x, y, z) and the position where it was hit (hitX, hitY, hitZ).
+// If either position is outside the view, the map only has "outOfView": true.
+func raycast(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	sx := int(arg[0].(float64))
+	sy := int(arg[1].(float64))
+	sz := int(arg[2].(float64))
+	ex := int(arg[3].(float64))
+	ey := int(arg[4].(float64))
+	ez := int(arg[5].(float64))
+	options, err := toRayOptions(ctx, arg, 6)
+	if err != nil {
+		return nil, err
+	}
+	app := ctx.App["app"].(*gfx.App)
+	hit, inView := app.View.Raycast(sx, sy, sz, ex, ey, ez, options)
+	if !inView {
+		return map[string]interface{}{"outOfView": true}, nil
+	}
+	if hit == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"shape": shapes.Shapes[hit.ShapeIndex].Name,
+		"x":     float64(hit.X),
+		"y":     float64(hit.Y),
+		"z":     float64(hit.Z),
+		"hitX":  float64(hit.HitX),
+		"hitY":  float64(hit.HitY),
+		"hitZ":  float64(hit.HitZ),
+	}, nil
+}
+
+func canSee(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
+	sx := int(arg[0].(float64))
+	sy := int(arg[1].(float64))
+	sz := int(arg[2].(float64))
+	dir := shapes.Direction(int(arg[3].(float64)))
+	fov := arg[4].(float64)
+	distance := arg[5].(float64)
+	ex := int(arg[6].(float64))
+	ey := int(arg[7].(float64))
+	ez := int(arg[8].(float64))
+	options, err := toRayOptions(ctx, arg, 9)
+	if err != nil {
+		return nil, err
+	}
+	app := ctx.App["app"].(*gfx.App)
+	return app.View.CanSee(sx, sy, sz, dir, fov, distance, ex, ey, ez, options), nil
+}
+
+func toRayOptions(ctx *bscript.Context, arg []interface{}, index int) (*spatial.RayOptions, error) {
+	options := &spatial.RayOptions{
+		Ignore:       map[*shapes.Shape]bool{},
+		IgnoreGroups: map[int]bool{},
+	}
+	if len(arg) > index {
+		if m, ok := arg[index].(map[string]interface{}); ok {
+			if names, ok := m["ignore"].(*[]interface{}); ok {
+				for _, name := range *names {
+					shapeIndex, ok := shapes.Names[name.(string)]
+					if !ok {
+						return nil, fmt.Errorf("%s unknown shape: %s", ctx.Pos, name)
+					}
+					options.Ignore[shapes.Shapes[shapeIndex]] = true
+				}
+			}
+			if groups, ok := m["ignoreGroups"].(*[]interface{}); ok {
+				for _, group := range *groups {
+					options.IgnoreGroups[int(group.(float64))] = true
+				}
+			}
+		}
+	}
+	return options, nil
+}
+
+func toPathOptions(ctx *bscript.Context, arg []interface{}, index int, isFlying bool) (*spatial.PathOptions, error) {
+	options := &spatial.PathOptions{
+		Profile: spatial.NewMovementProfile(isFlying),
+	}
+	if len(arg) > index {
+		if m, ok := arg[index].(map[string]interface{}); ok {
+			if flying, ok := m["flying"].(bool); ok {
+				options.Profile.IsFlying = flying
+			}
+			if maxStep, ok := m["maxStep"].(float64); ok {
+				options.Profile.MaxStep = int(maxStep)
+			}
+			if names, ok := m["passThrough"].(*[]interface{}); ok {
+				options.Profile.PassThrough = map[*shapes.Shape]bool{}
+				for _, name := range *names {
+					shapeIndex, ok := shapes.Names[name.(string)]
+					if !ok {
+						return nil, fmt.Errorf("%s unknown shape: %s", ctx.Pos, name)
+					}
+					options.Profile.PassThrough[shapes.Shapes[shapeIndex]] = true
+				}
+			}
+			if names, ok := m["block"].(*[]interface{}); ok {
+				for _, name := range *names {
+					shapeIndex, ok := shapes.Names[name.(string)]
+					if !ok {
+						return nil, fmt.Errorf("%s unknown shape: %s", ctx.Pos, name)
+					}
+					options.Profile.Blocking[shapes.Shapes[shapeIndex]] = true
+				}
+			}
+			if diagonal, ok := m["diagonal"].(bool); ok {
+				options.Diagonal = diagonal
+			}
+			if costs, ok := m["costs"].(map[string]interface{}); ok {
+				options.Costs = map[int]float32{}
+				for name, cost := range costs {
+					shapeIndex, ok := shapes.Names[name]
+					if !ok {
+						return nil, fmt.Errorf("%s unknown shape: %s", ctx.Pos, name)
+					}
+					options.Costs[shapeIndex] = float32(cost.(float64))
+				}
+			}
+		}
+	}
+	return options, nil
+}
+
+func toPathArray(path []spatial.PathStep) *[]interface{} {
+	r := make([]interface{}, len(path)*3)
+	for i, node := range path {
+		r[i*3] = float64(node[0])
+		r[i*3+1] = float64(node[1])
+		r[i*3+2] = float64(node[2])
+	}
+	return &r
 }
 
 func didClick(ctx *bscript.Context, arg ...interface{}) (interface{}, error) {
@@ -692,10 +1441,46 @@ func InitScript() {
 	bscript.AddBuiltin("eraseShapeExact", eraseShapeExact)
 	bscript.AddBuiltin("setShape", setShape)
 	bscript.AddBuiltin("moveShape", moveShape)
+	bscript.AddBuiltin("moveShapeEx", moveShapeEx)
+	bscript.AddBuiltin("setGravity", setGravity)
+	bscript.AddBuiltin("addLight", addLight)
+	bscript.AddBuiltin("delLight", delLight)
+	bscript.AddBuiltin("setWeather", setWeather)
+	bscript.AddBuiltin("getWeather", getWeather)
+	bscript.AddBuiltin("lightningFlash", lightningFlash)
+	bscript.AddBuiltin("startEmitter", startEmitter)
+	bscript.AddBuiltin("moveEmitter", moveEmitter)
+	bscript.AddBuiltin("stopEmitter", stopEmitter)
+	bscript.AddBuiltin("delEmitter", delEmitter)
+	bscript.AddBuiltin("screenshot", screenshot)
+	bscript.AddBuiltin("startCapture", startCapture)
+	bscript.AddBuiltin("stopCapture", stopCapture)
+	bscript.AddBuiltin("setFullscreen", setFullscreen)
+	bscript.AddBuiltin("isFullscreen", isFullscreen)
+	bscript.AddBuiltin("setScaleMode", setScaleMode)
+	bscript.AddBuiltin("getScaleMode", getScaleMode)
+	bscript.AddBuiltin("cameraFollow", cameraFollow)
+	bscript.AddBuiltin("cameraPath", cameraPath)
+	bscript.AddBuiltin("cameraStop", cameraStop)
+	bscript.AddBuiltin("cameraShake", cameraShake)
+	bscript.AddBuiltin("zoomTo", zoomTo)
+	bscript.AddBuiltin("getZoom", getZoom)
+	bscript.AddBuiltin("setCutaway", setCutaway)
+	bscript.AddBuiltin("clearCutaway", clearCutaway)
+	bscript.AddBuiltin("setPostEffect", setPostEffect)
+	bscript.AddBuiltin("setPostParam", setPostParam)
 	bscript.AddBuiltin("getShape", getShape)
 	bscript.AddBuiltin("setShapeExtra", setShapeExtra)
 	bscript.AddBuiltin("getShapeExtra", getShapeExtra)
 	bscript.AddBuiltin("eraseAllExtras", eraseAllExtras)
+	bscript.AddBuiltin("addLayer", addLayer)
+	bscript.AddBuiltin("removeLayer", removeLayer)
+	bscript.AddBuiltin("clearLayers", clearLayers)
+	bscript.AddBuiltin("getLayers", getLayers)
+	bscript.AddBuiltin("setVariant", setVariant)
+	bscript.AddBuiltin("getVariant", getVariant)
+	bscript.AddBuiltin("getShapeInfo", getShapeInfo)
+	bscript.AddBuiltin("reEdge", reEdge)
 	bscript.AddBuiltin("setAnimation", setAnimation)
 	bscript.AddBuiltin("setOffset", setOffset)
 	bscript.AddBuiltin("isEmpty", isEmpty)
@@ -725,6 +1510,15 @@ func InitScript() {
 	bscript.AddBuiltin("getScreenPos", getScreenPos)
 	bscript.AddBuiltin("distance", distance)
 	bscript.AddBuiltin("findPath", findPath)
+	bscript.AddBuiltin("requestPath", requestPath)
+	bscript.AddBuiltin("requestPathFar", requestPathFar)
+	bscript.AddBuiltin("pollPath", pollPath)
+	bscript.AddBuiltin("cancelPath", cancelPath)
+	bscript.AddBuiltin("createFlowField", createFlowField)
+	bscript.AddBuiltin("flowStep", flowStep)
+	bscript.AddBuiltin("deleteFlowField", deleteFlowField)
+	bscript.AddBuiltin("raycast", raycast)
+	bscript.AddBuiltin("canSee", canSee)
 	bscript.AddBuiltin("setPathThroughShapes", setPathThroughShapes)
 	bscript.AddBuiltin("didClick", didClick)
 	bscript.AddBuiltin("getClick", getClick)
@@ -0,0 +1,44 @@
+package shapes
+
+import "fmt"
+
+// Light is a point light given off by a shape (or placed by a script)
+type Light struct {
+	Color  [3]float32
+	Radius float32
+	// 0-1: how much the brightness varies over time
+	Flicker float32
+	// position relative to the shape's origin
+	Offset [3]float32
+}
+
+// NewLight parses a light definition: color is r,g,b in 0-255, radius is in world units.
+// The light is placed at offset, or at the center of size if there is no offset.
+func NewLight(def map[string]interface{}, size [3]float32) *Light {
+	light := &Light{
+		Color:  [3]float32{1, 1, 1},
+		Radius: 4,
+		Offset: [3]float32{size[0] / 2, size[1] / 2, size[2] / 2},
+	}
+	if color, ok := def["color"].([]interface{}); ok {
+		if len(color) < 3 {
+			panic(fmt.Sprintf("Light color should be r,g,b: %v", color))
+		}
+		light.Color = toColor(color)
+	}
+	if radius, ok := def["radius"].(float64); ok {
+		if radius <= 0 {
+			panic(fmt.Sprintf("Light radius should be positive: %v", radius))
+		}
+		light.Radius = float32(radius)
+	}
+	if flicker, ok := def["flicker"].(float64); ok {
+		light.Flicker = float32(flicker)
+	}
+	if offset, ok := def["offset"].([]interface{}); ok {
+		for i := range light.Offset {
+			light.Offset[i] = float32(offset[i].(float64))
+		}
+	}
+	return light
+}
@@ -52,6 +52,7 @@ type Shape struct {
 	ImageIndex     int
 	ShapeMeta      *ShapeMeta
 	Edges          map[string]map[string][]*Shape
+	EdgeTiling     map[string]string
 	Offset         [3]float32
 	EditorVisible  bool
 	Animations     map[int]*Animation
@@ -63,6 +64,12 @@ type Shape struct {
 	IsDraggable    bool
 	IsInteractive  bool
 	IsSaved        bool
+	PathCost       float32
+	Properties     map[string]interface{}
+	Light          *Light
+	// name of a custom shader from the config and its uniform values
+	Shader       string
+	ShaderParams map[string][]float32
 }
 
 type CursorDef struct {
@@ -72,10 +79,23 @@ type CursorDef struct {
 
 var Shapes []*Shape
 var Names map[string]int = map[string]int{}
+
+// shape indexes used by maps saved before version 6 (imageIndex*0x100 + position in the image) mapped to Shapes indexes
+var LegacyIndex map[int]int = map[int]int{}
 var Images []image.Image
 var UiImages map[string]image.Image = map[string]image.Image{}
 var Cursors []CursorDef
 
+// shape and creature definition keys handled by the engine, anything else goes into Shape.Properties
+var knownKeys map[string]bool = map[string]bool{
+	"name": true, "size": true, "pos": true, "fudge": true, "alphaMin": true, "offset": true,
+	"group": true, "ref": true, "target": true, "tiling": true, "pathCost": true, "dim": true, "frames": true,
+	"sway": true, "bob": true, "breathe": true, "nosupport": true, "extra": true, "drag": true, "interactive": true,
+	"light": true, "shader": true, "shaderParams": true,
+}
+
+const EDGE_TILING_BLOB = "blob"
+
 // some pre-defined animations
 const ANIMATION_MOVE = 0
 const ANIMATION_STAND = 1
@@ -201,7 +221,7 @@ func appendShape(index int, name string, shapeDef map[string]interface{}, imageI
 	}
 
 	shape := newShape(
-		imageIndex*0x100+index, // each image can contain max 256 shapes
+		len(Shapes),
 		name,
 		group,
 		size,
@@ -231,6 +251,9 @@ func appendShape(index int, name string, shapeDef map[string]interface{}, imageI
 		if _, ok := ref.Edges[target]; ok == false {
 			ref.Edges[target] = map[string][]*Shape{}
 		}
+		if tiling, ok := shapeDef["tiling"].(string); ok {
+			ref.EdgeTiling[target] = tiling
+		}
 		if _, ok := ref.Edges[target][parts[2]]; ok {
 			ref.Edges[target][parts[2]] = append(ref.Edges[target][parts[2]], shape)
 		} else {
@@ -240,13 +263,10 @@ func appendShape(index int, name string, shapeDef map[string]interface{}, imageI
 		shape.EditorVisible = true
 	}
 
-	// add a gap, if needed
-	for len(Shapes) < shape.Index {
-		Shapes = append(Shapes, nil)
-	}
 	// add shape
 	Shapes = append(Shapes, shape)
 	Names[name] = shape.Index
+	LegacyIndex[imageIndex*0x100+index] = shape.Index
 }
 
 func (shape *Shape) addExtras(shapeDef map[string]interface{}) {
@@ -276,6 +296,50 @@ func (shape *Shape) addExtras(shapeDef map[string]interface{}) {
 	if interactive, ok := shapeDef["interactive"].(bool); ok {
 		shape.IsInteractive = interactive
 	}
+	// cost multiplier for pathfinding when walking on top of this shape
+	shape.PathCost = 1
+	if pathCost, ok := shapeDef["pathCost"].(float64); ok {
+		shape.PathCost = float32(pathCost)
+	}
+	// point light
+	if light, ok := shapeDef["light"].(map[string]interface{}); ok {
+		shape.Light = NewLight(light, shape.Size)
+	}
+	// custom shader
+	if shader, ok := shapeDef["shader"].(string); ok {
+		shape.Shader = shader
+	}
+	shape.ShaderParams = map[string][]float32{}
+	if params, ok := shapeDef["shaderParams"].(map[string]interface{}); ok {
+		for k, v := range params {
+			shape.ShaderParams[k] = ParseShaderParam(v)
+		}
+	}
+	// game specific properties
+	shape.Properties = map[string]interface{}{}
+	for k, v := range shapeDef {
+		if knownKeys[k] == false {
+			shape.Properties[k] = v
+		}
+	}
+}
+
+// ParseShaderParam reads a uniform value: a number or a list of up to 4 numbers
+func ParseShaderParam(value interface{}) []float32 {
+	switch v := value.(type) {
+	case float64:
+		return []float32{float32(v)}
+	case []interface{}:
+		if len(v) == 0 || len(v) > 4 {
+			panic(fmt.Sprintf("Shader parameter should have 1 to 4 values: %v", v))
+		}
+		values := []float32{}
+		for _, n := range v {
+			values = append(values, float32(n.(float64)))
+		}
+		return values
+	}
+	panic(fmt.Sprintf("Shader parameter should be a number or a list: %v", value))
 }
 
 func (shape *Shape) HasEdges(shapeName string) bool {
@@ -290,6 +354,19 @@ func (shape *Shape) HasEdges(shapeName string) bool {
 	return false
 }
 
+// Edge names: the default tiling uses the 4 orthogonal neighbors (n, s, e, w), named like
+// "n", "ne", "ns", "nse" or "nsew". An edge set can instead use 8 neighbor blob tiling
+// (47 tiles) by adding "tiling": "blob" to any of its edge shapes. Blob names start with the
+// orthogonal part and add an inner corner for each diagonal neighbor whose two adjacent
+// orthogonal neighbors are both absent, in the order ne, nw, se, sw. For example:
+// "cne" (only the north-east diagonal), "cne_csw", "n_cse_csw" or "e_cnw".
+func (shape *Shape) IsBlobTiling(shapeName string) bool {
+	if _, ok := shape.Edges[shapeName]; ok == false {
+		shapeName = "default"
+	}
+	return shape.EdgeTiling[shapeName] == EDGE_TILING_BLOB
+}
+
 func (shape *Shape) GetEdge(shapeName, edgeName string) *Shape {
 	edgeMap, ok := shape.Edges[shapeName]
 	if ok == false {
@@ -327,6 +404,7 @@ func newShape(index int, name string, group int, size [3]float32, px, py, pw, ph
 		ImageIndex: imageIndex,
 		ShapeMeta:  shapeMeta,
 		Edges:      map[string]map[string][]*Shape{},
+		EdgeTiling: map[string]string{},
 		Offset:     offset,
 		IsSaved:    true,
 	}
@@ -368,7 +446,7 @@ func InitCreatures(gameDir string, data []map[string]interface{}) error {
 		size := [3]float32{float32(sizeI[0].(float64)), float32(sizeI[1].(float64)), float32(sizeI[2].(float64))}
 
 		shape := &Shape{
-			Index:         imageIndex * 0x100,
+			Index:         len(Shapes),
 			Name:          name,
 			Size:          size,
 			ImageIndex:    imageIndex,
@@ -379,12 +457,9 @@ func InitCreatures(gameDir string, data []map[string]interface{}) error {
 		}
 		shape.addExtras(block)
 
-		// add a gap, if needed
-		for len(Shapes) < shape.Index {
-			Shapes = append(Shapes, nil)
-		}
 		Shapes = append(Shapes, shape)
 		Names[name] = shape.Index
+		LegacyIndex[imageIndex*0x100] = shape.Index
 
 		dimI := block["dim"].([]interface{})
 		dim := [2]int{int(dimI[0].(float64)), int(dimI[1].(float64))}
@@ -0,0 +1,67 @@
+package shapes
+
+import (
+	"fmt"
+)
+
+// max number of colour remap entries per variant (size of the shader uniform arrays)
+const MAX_REMAP = 8
+
+const remapToleranceDefault = 8
+
+// Variant is a recolouring of a base shape: an optional colour remap table
+// followed by an optional hsv shift. It is applied per placed instance in
+// the fragment shader.
+type Variant struct {
+	Name       string
+	Hsv        [3]float32
+	RemapFrom  [MAX_REMAP][3]float32
+	RemapTo    [MAX_REMAP][3]float32
+	RemapCount int
+	Tolerance  float32
+}
+
+var Variants []*Variant
+var VariantNames map[string]int = map[string]int{}
+
+func InitVariants(data []map[string]interface{}) error {
+	for _, block := range data {
+		name := block["name"].(string)
+		v := &Variant{
+			Name:      name,
+			Tolerance: remapToleranceDefault / 255.0,
+		}
+		// hue shift in degrees, saturation and value offsets in -1..1
+		if hsvI, ok := block["hsv"].([]interface{}); ok {
+			v.Hsv[0] = float32(hsvI[0].(float64)) / 360.0
+			v.Hsv[1] = float32(hsvI[1].(float64))
+			v.Hsv[2] = float32(hsvI[2].(float64))
+		}
+		if tolerance, ok := block["tolerance"].(float64); ok {
+			v.Tolerance = float32(tolerance) / 255.0
+		}
+		if remapI, ok := block["remap"].([]interface{}); ok {
+			if len(remapI) > MAX_REMAP {
+				return fmt.Errorf("variant %s: at most %d remap colors are supported", name, MAX_REMAP)
+			}
+			for i, r := range remapI {
+				entry := r.(map[string]interface{})
+				v.RemapFrom[i] = toColor(entry["from"].([]interface{}))
+				v.RemapTo[i] = toColor(entry["to"].([]interface{}))
+			}
+			v.RemapCount = len(remapI)
+		}
+		VariantNames[name] = len(Variants)
+		Variants = append(Variants, v)
+	}
+	fmt.Printf("Loaded %d variants.\n", len(Variants))
+	return nil
+}
+
+func toColor(rgb []interface{}) [3]float32 {
+	return [3]float32{
+		float32(rgb[0].(float64)) / 255.0,
+		float32(rgb[1].(float64)) / 255.0,
+		float32(rgb[2].(float64)) / 255.0,
+	}
+}
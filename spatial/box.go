@@ -1,4 +1,4 @@
-package gfx
+package spatial
 
 import "fmt"
 
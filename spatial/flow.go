@@ -0,0 +1,253 @@
+package spatial
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/uzudil/isongn/util"
+	"github.com/uzudil/isongn/world"
+)
+
+// flee fields scale the distance to the target by this, before relaxing them again
+const FLEE_FACTOR = -1.2
+
+type flowEdge struct {
+	to   PathStep
+	cost int
+}
+
+// FlowField is a Dijkstra map of the cost to reach a target, built over the view's collision grid.
+// Creatures ignore each other when it is built, so one field can serve a crowd. It's rebuilt when
+// the grid changes.
+type FlowField struct {
+	radius     int
+	size       int
+	options    *PathOptions
+	generation int
+	target     PathStep
+	diagonal   bool
+	maxStep    int
+	dist       map[PathStep]int
+	flee       map[PathStep]int
+	edges      map[PathStep][]flowEdge
+}
+
+type flowNode struct {
+	pos       *Cell
+	key       PathStep
+	value     int
+	closed    bool
+	heapIndex int
+}
+
+// CreateFlowField builds a flow field toward a world position, covering radius positions around it.
+// Size is the footprint of the creatures using it. Returns a handle for FlowStep.
+func (grid *Grid) CreateFlowField(x, y, z, radius, size int, options *PathOptions) int {
+	grid.flowHandle++
+	grid.flowFields[grid.flowHandle] = grid.newFlowField(x, y, z, radius, size, options)
+	return grid.flowHandle
+}
+
+func (grid *Grid) DeleteFlowField(handle int) {
+	delete(grid.flowFields, handle)
+}
+
+// FlowStep returns the best next position from (x, y, z), toward the target or away from it if flee is set.
+// Returns false if the field is unknown or there is no better position.
+func (grid *Grid) FlowStep(handle, x, y, z int, flee bool) (PathStep, bool) {
+	field, ok := grid.flowFields[handle]
+	if !ok {
+		return PathStep{}, false
+	}
+	if field.generation != grid.generation {
+		field = grid.newFlowField(field.target[0], field.target[1], field.target[2], field.radius, field.size, field.options)
+		grid.flowFields[handle] = field
+	}
+	return field.step(x, y, z, flee)
+}
+
+func (grid *Grid) newFlowField(x, y, z, radius, size int, options *PathOptions) *FlowField {
+	field := &FlowField{
+		radius:     radius,
+		size:       size,
+		options:    options,
+		generation: grid.generation,
+		target:     PathStep{x, y, z},
+		diagonal:   options.Diagonal,
+		maxStep:    options.Profile.MaxStep,
+		dist:       map[PathStep]int{},
+		edges:      map[PathStep][]flowEdge{},
+	}
+	viewX, viewY, viewZ, validPos := grid.ToViewPos(x, y, z)
+	if !validPos {
+		return field
+	}
+
+	search := &pathSearch{options: options, blockers: map[*Cell]*Cell{}}
+	grid.context.isPathing = true
+	grid.context.profile = options.Profile
+	grid.context.usePathThrough = options.Profile.PassThrough != nil
+	grid.context.start = nil
+	grid.context.end = nil
+	grid.context.search = search
+	grid.context.box = &BoundingBox{0, 0, 0, size, size, 4}
+	grid.context.ignoreCreatures = true
+	defer func() {
+		grid.context.isPathing = false
+		grid.context.search = nil
+		grid.context.box = nil
+		grid.context.ignoreCreatures = false
+	}()
+
+	// Dijkstra from the target, over the moves that lead onto each position
+	nodes := map[*Cell]*flowNode{}
+	start := &flowNode{pos: grid.Cells[viewX][viewY][viewZ], key: field.target}
+	nodes[start.pos] = start
+	openList := &flowHeap{}
+	heap.Push(openList, start)
+	for openList.Len() > 0 {
+		current := heap.Pop(openList).(*flowNode)
+		current.closed = true
+		field.dist[current.key] = current.value
+		for _, neighbor := range search.flowNeighbors(grid, current.pos) {
+			if util.AbsInt(neighbor.node.X-viewX) > radius || util.AbsInt(neighbor.node.Y-viewY) > radius {
+				continue
+			}
+			// the cost of stepping from the neighbor onto current
+			cost := search.stepCost(grid, current.pos, neighbor.cost)
+			node, ok := nodes[neighbor.node]
+			if !ok {
+				wx, wy, wz := grid.ToWorldPos(neighbor.node.X, neighbor.node.Y, neighbor.node.Z)
+				node = &flowNode{pos: neighbor.node, key: PathStep{wx, wy, wz}, value: current.value + cost}
+				nodes[neighbor.node] = node
+				heap.Push(openList, node)
+			} else if !node.closed && current.value+cost < node.value {
+				node.value = current.value + cost
+				heap.Fix(openList, node.heapIndex)
+			}
+			field.edges[current.key] = append(field.edges[current.key], flowEdge{node.key, cost})
+		}
+	}
+	return field
+}
+
+// the positions around node that a creature can move onto node from. Moves aren't reversible
+// (a creature can drop down further than it can step up), so each one is tried from the neighbor.
+func (search *pathSearch) flowNeighbors(grid *Grid, node *Cell) []pathNeighbor {
+	ret := []pathNeighbor{}
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			if (dx == 0 && dy == 0) || (!search.options.Diagonal && dx != 0 && dy != 0) {
+				continue
+			}
+			x := node.X + dx
+			y := node.Y + dy
+			if !grid.IsValidViewPos(x, y, 0) {
+				continue
+			}
+			// the positions in this column a creature can stand on
+			minZ := node.Z - grid.context.profile.MaxStep
+			if minZ < 0 {
+				minZ = 0
+			}
+			for z := minZ; z < world.SECTION_Z_SIZE; z++ {
+				cell := grid.Cells[x][y][z]
+				if grid.getBlockerWithCache(cell) != nil || (z > 0 && grid.getBlockerWithCache(grid.Cells[x][y][z-1]) == nil) {
+					continue
+				}
+				for _, move := range search.astarNeighbors(grid, cell) {
+					if move.node == node {
+						ret = append(ret, pathNeighbor{cell, move.cost})
+						break
+					}
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// the flee field: scaled, negated distances relaxed again, so fleeing creatures don't get stuck in corners
+func (field *FlowField) buildFlee() {
+	field.flee = map[PathStep]int{}
+	nodes := map[PathStep]*flowNode{}
+	openList := &flowHeap{}
+	for key, dist := range field.dist {
+		node := &flowNode{key: key, value: int(math.Round(float64(dist) * FLEE_FACTOR))}
+		nodes[key] = node
+		heap.Push(openList, node)
+	}
+	for openList.Len() > 0 {
+		current := heap.Pop(openList).(*flowNode)
+		current.closed = true
+		field.flee[current.key] = current.value
+		for _, edge := range field.edges[current.key] {
+			node := nodes[edge.to]
+			if !node.closed && current.value+edge.cost < node.value {
+				node.value = current.value + edge.cost
+				heap.Fix(openList, node.heapIndex)
+			}
+		}
+	}
+}
+
+func (field *FlowField) step(x, y, z int, flee bool) (PathStep, bool) {
+	values := field.dist
+	if flee {
+		if field.flee == nil {
+			field.buildFlee()
+		}
+		values = field.flee
+	}
+	best := PathStep{}
+	bestValue, found := values[PathStep{x, y, z}]
+	if !found {
+		bestValue = math.MaxInt32
+	}
+	moved := false
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			if (dx == 0 && dy == 0) || (!field.diagonal && dx != 0 && dy != 0) {
+				continue
+			}
+			// the highest position we could step up or drop down to
+			for zz := z + field.maxStep; zz >= 0; zz-- {
+				if value, ok := values[PathStep{x + dx, y + dy, zz}]; ok {
+					if value < bestValue {
+						best = PathStep{x + dx, y + dy, zz}
+						bestValue = value
+						moved = true
+					}
+					break
+				}
+			}
+		}
+	}
+	return best, moved
+}
+
+type flowHeap []*flowNode
+
+func (h flowHeap) Len() int           { return len(h) }
+func (h flowHeap) Less(i, j int) bool { return h[i].value < h[j].value }
+
+func (h flowHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *flowHeap) Push(x interface{}) {
+	node := x.(*flowNode)
+	node.heapIndex = len(*h)
+	*h = append(*h, node)
+}
+
+func (h *flowHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	node := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return node
+}
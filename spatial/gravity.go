@@ -0,0 +1,80 @@
+package spatial
+
+import (
+	"github.com/uzudil/isongn/shapes"
+)
+
+// Landing is a shape that fell and came to rest at X, Y, Z
+type Landing struct {
+	ShapeIndex int
+	X, Y, Z    int
+	FromZ      int
+}
+
+// SetGravity turns the physics pass on or off. When on, shapes resting on an erased or moved
+// shape fall until they land on something (or the ground).
+func (grid *Grid) SetGravity(enabled bool) {
+	grid.gravity = enabled
+}
+
+// TakeLandings returns the shapes that landed since the last call
+func (grid *Grid) TakeLandings() []Landing {
+	landings := grid.landings
+	grid.landings = nil
+	return landings
+}
+
+// drop the shapes standing on top of box (view coordinates), which was just vacated
+func (grid *Grid) settle(box BoundingBox) {
+	if !grid.gravity {
+		return
+	}
+	top := box.Z + box.D
+	if !grid.IsValidViewPos(box.X, box.Y, top) {
+		return
+	}
+	above := []*Cell{}
+	grid.search(box.X+box.W-1, box.Y+box.H-1, top, func(cell *Cell) bool {
+		if cell.Z == top &&
+			sideOverlap(cell.Box.X, cell.Box.X+cell.Box.W, box.X, box.X+box.W) &&
+			sideOverlap(cell.Box.Y, cell.Box.Y+cell.Box.H, box.Y, box.Y+box.H) {
+			above = append(above, cell)
+		}
+		return false
+	})
+	for _, cell := range above {
+		grid.fall(cell)
+	}
+}
+
+func (grid *Grid) fall(cell *Cell) {
+	if cell.Pos.Block == 0 || shapes.Shapes[cell.Pos.Block-1].NoSupport {
+		return
+	}
+	grid.context.isPathing = false
+	fallBox := cell.Box
+	z := cell.Z
+	for z > 0 && grid.getBlockerAt(cell.X, cell.Y, z-1, &fallBox, cell) == nil {
+		z--
+	}
+	if z == cell.Z {
+		return
+	}
+	box := cell.Box
+	shapeIndex := cell.Pos.Block - 1
+	landed := grid.relocate(cell.WorldX, cell.WorldY, cell.WorldZ, cell.WorldX, cell.WorldY, z)
+	if landed == nil {
+		return
+	}
+	grid.landings = append(grid.landings, Landing{
+		ShapeIndex: shapeIndex,
+		X:          landed.WorldX,
+		Y:          landed.WorldY,
+		Z:          landed.WorldZ,
+		FromZ:      cell.WorldZ,
+	})
+	if grid.observer != nil {
+		grid.observer.CellFell(landed, cell.Z-z)
+	}
+	grid.settle(box)
+}
@@ -0,0 +1,517 @@
+package spatial
+
+import (
+	"fmt"
+
+	"github.com/uzudil/isongn/shapes"
+	"github.com/uzudil/isongn/world"
+)
+
+const (
+	SIZE        = 96
+	SEARCH_SIZE = 16
+)
+
+// Cell is a position of the grid, holding the shape whose origin is here (if any)
+type Cell struct {
+	X, Y, Z                int
+	WorldX, WorldY, WorldZ int
+	Pos                    *world.SectionPosition
+	Box                    BoundingBox
+}
+
+// Source is where the grid's shapes are stored (the world.Loader)
+type Source interface {
+	GetCenter() (int, int)
+	GetPos(x, y, z int) *world.SectionPosition
+	SetShape(x, y, z int, shapeIndex int) bool
+	EraseShape(x, y, z int) bool
+	SetLayers(x, y, z int, layers []int)
+}
+
+// GridObserver is notified when a shape is placed in a cell
+type GridObserver interface {
+	CellChanged(cell *Cell)
+	// the shape in cell fell from distance above
+	CellFell(cell *Cell, distance int)
+	// the shape in cell was moved from another origin
+	CellMoved(cell *Cell, fromX, fromY, fromZ int)
+}
+
+// Grid is a SIZExSIZE window of the world centered on the Source's center. It implements collision,
+// pathfinding and other spatial queries without any rendering.
+type Grid struct {
+	Source       Source
+	Nav          *world.NavGrid
+	Cells        [SIZE][SIZE][world.SECTION_Z_SIZE]*Cell
+	observer     GridObserver
+	context      ViewContext
+	pathRequests map[int]*PathRequest
+	pathHandle   int
+	flowFields   map[int]*FlowField
+	flowHandle   int
+	// changes when the grid is reloaded or its saved shapes change, flow fields are rebuilt then
+	generation int
+	gravity    bool
+	landings   []Landing
+}
+
+// NewGrid creates a grid over source. If newCell is not nil, it creates the cells (so they can be
+// embedded in other structures). Nav and observer are optional.
+func NewGrid(source Source, nav *world.NavGrid, observer GridObserver, newCell func(x, y, z int) *Cell) *Grid {
+	grid := &Grid{
+		Source:       source,
+		Nav:          nav,
+		observer:     observer,
+		pathRequests: map[int]*PathRequest{},
+		flowFields:   map[int]*FlowField{},
+	}
+	grid.context.pathThroughShapes = map[*shapes.Shape]bool{}
+	grid.context.profile = NewMovementProfile(false)
+	for x := 0; x < SIZE; x++ {
+		for y := 0; y < SIZE; y++ {
+			for z := 0; z < world.SECTION_Z_SIZE; z++ {
+				if newCell != nil {
+					grid.Cells[x][y][z] = newCell(x, y, z)
+				} else {
+					grid.Cells[x][y][z] = &Cell{X: x, Y: y, Z: z}
+				}
+			}
+		}
+	}
+	return grid
+}
+
+// Load the cells from the source, after its center moved
+func (grid *Grid) Load() {
+	for x := 0; x < SIZE; x++ {
+		for y := 0; y < SIZE; y++ {
+			for z := 0; z < world.SECTION_Z_SIZE; z++ {
+				worldX, worldY, worldZ := grid.ToWorldPos(x, y, z)
+				cell := grid.Cells[x][y][z]
+				cell.WorldX = worldX
+				cell.WorldY = worldY
+				cell.WorldZ = worldZ
+				grid.setPos(cell, grid.Source.GetPos(worldX, worldY, worldZ))
+			}
+		}
+	}
+	grid.generation++
+	grid.restartPathRequests()
+}
+
+func (grid *Grid) setPos(cell *Cell, sectionPos *world.SectionPosition) {
+	cell.Pos = sectionPos
+	if sectionPos.Block > 0 {
+		shape := shapes.Shapes[sectionPos.Block-1]
+		cell.Box.Set(
+			cell.X, cell.Y, cell.Z,
+			int(shape.Size[0]), int(shape.Size[1]), int(shape.Size[2]),
+		)
+	}
+}
+
+func (grid *Grid) ToWorldPos(viewX, viewY, viewZ int) (int, int, int) {
+	centerX, centerY := grid.Source.GetCenter()
+	return viewX + (centerX - SIZE/2), viewY + (centerY - SIZE/2), viewZ
+}
+
+func (grid *Grid) IsValidViewPos(viewX, viewY, viewZ int) bool {
+	return !(viewX < 0 || viewX >= SIZE || viewY < 0 || viewY >= SIZE || viewZ < 0 || viewZ >= world.SECTION_Z_SIZE)
+}
+
+func (grid *Grid) ToViewPos(worldX, worldY, worldZ int) (int, int, int, bool) {
+	centerX, centerY := grid.Source.GetCenter()
+	viewX := worldX - (centerX - SIZE/2)
+	viewY := worldY - (centerY - SIZE/2)
+	return viewX, viewY, worldZ, grid.IsValidViewPos(viewX, viewY, worldZ)
+}
+
+func (grid *Grid) InView(worldX, worldY, worldZ int) bool {
+	_, _, _, validPos := grid.ToViewPos(worldX, worldY, worldZ)
+	return validPos
+}
+
+func (grid *Grid) search(viewX, viewY, viewZ int, fx func(*Cell) bool) {
+	for x := 0; x < SEARCH_SIZE; x++ {
+		for y := 0; y < SEARCH_SIZE; y++ {
+			for z := 0; z < SEARCH_SIZE; z++ {
+				vx := viewX - x
+				vy := viewY - y
+				vz := viewZ - z
+				if grid.IsValidViewPos(vx, vy, vz) {
+					cell := grid.Cells[vx][vy][vz]
+					if cell.Pos.Block > 0 && fx(cell) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// GetShapeAt returns the cell of the shape covering a position
+func (grid *Grid) GetShapeAt(viewX, viewY, viewZ int) *Cell {
+	var res *Cell
+	grid.search(viewX, viewY, viewZ, func(cell *Cell) bool {
+		if cell.Box.isInside(viewX, viewY, viewZ) {
+			res = cell
+			return true
+		}
+		return false
+	})
+	return res
+}
+
+func (grid *Grid) GetShape(worldX, worldY, worldZ int) (int, int, int, int, bool) {
+	viewX, viewY, viewZ, validPos := grid.ToViewPos(worldX, worldY, worldZ)
+	if !validPos {
+		return 0, 0, 0, 0, false
+	}
+	b := grid.GetShapeAt(viewX, viewY, viewZ)
+	if b == nil || b.Pos.Block == 0 {
+		return 0, 0, 0, 0, false
+	}
+	originWorldX, originWorldY, originWorldZ := grid.ToWorldPos(b.X, b.Y, b.Z)
+	return b.Pos.Block - 1, originWorldX, originWorldY, originWorldZ, true
+}
+
+func (grid *Grid) GetBlocker(toWorldX, toWorldY, toWorldZ int) *Cell {
+	if grid.context.box != nil {
+		toViewX, toViewY, toViewZ, validPos := grid.ToViewPos(toWorldX, toWorldY, toWorldZ)
+		if !validPos {
+			return nil
+		}
+		return grid.getBlockerAt(toViewX, toViewY, toViewZ, grid.context.box, nil)
+	}
+
+	src := grid.context.start
+	if src.Pos.Block == 0 {
+		fmt.Printf("WARN: Grid.GetBlocker src position empty %d,%d,%d\n", src.X, src.Y, src.Z)
+		return nil
+	}
+
+	toViewX, toViewY, toViewZ, validPos := grid.ToViewPos(toWorldX, toWorldY, toWorldZ)
+	if !validPos {
+		print("WARN: Grid.GetBlocker dest position invalid\n")
+		return nil
+	}
+
+	return grid.getBlockerAt(toViewX, toViewY, toViewZ, &src.Box, src)
+}
+
+func (grid *Grid) getBlockerAt(toViewX, toViewY, toViewZ int, box *BoundingBox, src *Cell) *Cell {
+	oldViewX := box.X
+	oldViewY := box.Y
+	oldViewZ := box.Z
+	box.SetPos(toViewX, toViewY, toViewZ)
+
+	var blocker *Cell
+	grid.search(toViewX+box.W, toViewY+box.H, toViewZ+box.D, func(cell *Cell) bool {
+		pathThrough := false
+		if grid.context.isPathing {
+			shape := shapes.Shapes[cell.Pos.Block-1]
+			if grid.context.usePathThrough && !grid.context.profile.Blocking[shape] {
+				if grid.context.profile.PassThrough != nil {
+					pathThrough = grid.context.profile.PassThrough[shape]
+				} else {
+					_, pathThrough = grid.context.pathThroughShapes[shape]
+				}
+			}
+			if cell == grid.context.end || (grid.context.ignoreCreatures && !shape.IsSaved) {
+				pathThrough = true
+			}
+		}
+		if !pathThrough && cell != src && cell.Box.intersect(box) {
+			blocker = cell
+			return true
+		}
+		return false
+	})
+	box.SetPos(oldViewX, oldViewY, oldViewZ)
+	return blocker
+}
+
+func (grid *Grid) IsEmpty(toWorldX, toWorldY, toWorldZ int, shape *shapes.Shape) bool {
+	viewX, viewY, viewZ, validPos := grid.ToViewPos(toWorldX, toWorldY, toWorldZ)
+	if !validPos {
+		return false
+	}
+	box := &BoundingBox{0, 0, 0, int(shape.Size[0]), int(shape.Size[1]), int(shape.Size[2])}
+	return grid.getBlockerAt(viewX, viewY, viewZ, box, nil) == nil
+}
+
+// FindTop returns the lowest z where shape fits on top of everything at worldX, worldY below maxZ
+func (grid *Grid) FindTop(worldX, worldY int, shape *shapes.Shape, maxZ int) int {
+	top := 0
+	viewX, viewY, _, validPos := grid.ToViewPos(worldX, worldY, top)
+	if validPos {
+		box := &BoundingBox{0, 0, 0, int(shape.Size[0]), int(shape.Size[1]), int(shape.Size[2])}
+		for z := maxZ - 1; z >= 0; z-- {
+			box.SetPos(viewX, viewY, z)
+			grid.search(viewX+box.W, viewY+box.H, z+box.D, func(cell *Cell) bool {
+				if cell.Box.intersect(box) && cell.Z < maxZ && z+1 > top {
+					top = z + 1
+				}
+				return false
+			})
+		}
+	}
+	return top
+}
+
+const (
+	BLOCKED_WALL      = "wall"
+	BLOCKED_CREATURE  = "creature"
+	BLOCKED_NOSUPPORT = "nosupport"
+	BLOCKED_VIEW      = "view"
+)
+
+// MoveResult is the outcome of MoveShapeEx
+type MoveResult struct {
+	// the new z, or -1 if the shape won't fit
+	Z int
+	// why the move failed (one of the BLOCKED_ constants) or "" on success
+	Reason string
+	// the shape in the way and its origin, BlockerIndex is -1 if there is none
+	BlockerIndex                 int
+	BlockerX, BlockerY, BlockerZ int
+	// true if the blocker was pushed out of the way
+	Pushed bool
+}
+
+// Move a shape from (worldX, worldY, worldZ) to a new position of (newWorldX, newWorldY).
+// Returns the new Z value, or -1 if the shape won't fit.
+func (grid *Grid) MoveShape(worldX, worldY, worldZ, newWorldX, newWorldY int, isFlying bool) int {
+	return grid.MoveShapeEx(worldX, worldY, worldZ, newWorldX, newWorldY, isFlying, false).Z
+}
+
+// MoveShapeEx is MoveShape that also describes what blocked the move. If push is true, a draggable
+// blocker is moved along in the same direction and the move is tried again, if both fit.
+func (grid *Grid) MoveShapeEx(worldX, worldY, worldZ, newWorldX, newWorldY int, isFlying, push bool) *MoveResult {
+	result := grid.moveShape(worldX, worldY, worldZ, newWorldX, newWorldY, isFlying)
+	if result.Z >= 0 || !push || result.BlockerIndex < 0 || result.Reason == BLOCKED_NOSUPPORT || !shapes.Shapes[result.BlockerIndex].IsDraggable {
+		return result
+	}
+	dx := newWorldX - worldX
+	dy := newWorldY - worldY
+	blockerPos, _ := grid.planMove(result.BlockerX, result.BlockerY, result.BlockerZ, result.BlockerX+dx, result.BlockerY+dy, false)
+	if blockerPos == nil {
+		return result
+	}
+	// check that the retry fits with the blocker out of the way, before moving anything
+	blocker := grid.context.start
+	box := blocker.Box
+	blocker.Box.SetPos(blockerPos.X, blockerPos.Y, blockerPos.Z)
+	newPos, _ := grid.planMove(worldX, worldY, worldZ, newWorldX, newWorldY, isFlying)
+	blocker.Box = box
+	if newPos == nil {
+		return result
+	}
+	blockerZ := grid.moveShape(result.BlockerX, result.BlockerY, result.BlockerZ, result.BlockerX+dx, result.BlockerY+dy, false).Z
+	if blockerZ < 0 {
+		return result
+	}
+	pushed := grid.moveShape(worldX, worldY, worldZ, newWorldX, newWorldY, isFlying)
+	pushed.Pushed = true
+	if pushed.Z >= 0 {
+		pushed.BlockerIndex = result.BlockerIndex
+		pushed.BlockerX = result.BlockerX + dx
+		pushed.BlockerY = result.BlockerY + dy
+		pushed.BlockerZ = blockerZ
+	}
+	return pushed
+}
+
+func (grid *Grid) moveShape(worldX, worldY, worldZ, newWorldX, newWorldY int, isFlying bool) *MoveResult {
+	newPos, result := grid.planMove(worldX, worldY, worldZ, newWorldX, newWorldY, isFlying)
+	if newPos != nil {
+		box := grid.context.start.Box
+		grid.relocate(worldX, worldY, worldZ, newWorldX, newWorldY, newPos.Z)
+		grid.settle(box)
+	}
+	return result
+}
+
+// Returns where the shape would move to without moving it, or nil and what's in the way.
+// Leaves context.start set to the shape's cell.
+func (grid *Grid) planMove(worldX, worldY, worldZ, newWorldX, newWorldY int, isFlying bool) (*Cell, *MoveResult) {
+	result := &MoveResult{Z: -1, Reason: BLOCKED_VIEW, BlockerIndex: -1}
+	newViewX, newViewY, _, validPos := grid.ToViewPos(newWorldX, newWorldY, 0)
+	if !validPos {
+		return nil, result
+	}
+
+	startViewX, startViewY, startViewZ, validPos := grid.ToViewPos(worldX, worldY, worldZ)
+	if !validPos {
+		return nil, result
+	}
+
+	// figure out the new Z
+	grid.context.isPathing = false
+	grid.context.profile = NewMovementProfile(isFlying)
+	grid.context.start = grid.Cells[startViewX][startViewY][startViewZ]
+	grid.context.blocker = nil
+	grid.context.noSupport = false
+	newPos := grid.tryMove(newViewX, newViewY, worldZ)
+	if newPos != nil {
+		result.Z = newPos.Z
+		result.Reason = ""
+		return newPos, result
+	}
+
+	if blocker := grid.context.blocker; blocker != nil {
+		shape := shapes.Shapes[blocker.Pos.Block-1]
+		result.BlockerIndex = shape.Index
+		result.BlockerX = blocker.WorldX
+		result.BlockerY = blocker.WorldY
+		result.BlockerZ = blocker.WorldZ
+		if grid.context.noSupport {
+			result.Reason = BLOCKED_NOSUPPORT
+		} else if shape.IsSaved {
+			result.Reason = BLOCKED_WALL
+		} else {
+			result.Reason = BLOCKED_CREATURE
+		}
+	}
+	return nil, result
+}
+
+// Returns the position the shape moves to, or nil and sets context.blocker to what's in the way.
+func (grid *Grid) tryMove(newViewX, newViewY, newViewZ int) *Cell {
+	// can we drop down here? (check this before the same-z move)
+	z := newViewZ
+	var standingOn *Cell
+	for z > 0 {
+		standingOn = grid.getBlockerWithCache(grid.Cells[newViewX][newViewY][z-1])
+		if standingOn != nil {
+			break
+		}
+		z--
+	}
+	if standingOn != nil {
+		standingOnShape := shapes.Shapes[standingOn.Pos.Block-1]
+		if (!grid.context.profile.IsFlying && standingOnShape.NoSupport) || grid.context.profile.Blocking[standingOnShape] {
+			grid.context.blocker = standingOn
+			grid.context.noSupport = true
+			return nil
+		}
+	}
+	if z < newViewZ {
+		return grid.Cells[newViewX][newViewY][z]
+	}
+
+	// same z move
+	newNode := grid.Cells[newViewX][newViewY][newViewZ]
+	blocker := grid.getBlockerWithCache(newNode)
+	if blocker == nil {
+		return newNode
+	}
+
+	// step up?
+	for step := 1; step <= grid.context.profile.MaxStep && newViewZ+step < world.SECTION_Z_SIZE; step++ {
+		newNode = grid.Cells[newViewX][newViewY][newViewZ+step]
+		if grid.getBlockerWithCache(newNode) == nil {
+			return newNode
+		}
+	}
+	grid.context.blocker = blocker
+	return nil
+}
+
+func (grid *Grid) getBlockerWithCache(node *Cell) *Cell {
+	if grid.context.isPathing {
+		blocker, ok := grid.context.search.blockers[node]
+		if !ok {
+			blocker = grid.GetBlocker(node.WorldX, node.WorldY, node.WorldZ)
+			grid.context.search.blockers[node] = blocker
+		}
+		return blocker
+	} else {
+		return grid.GetBlocker(node.WorldX, node.WorldY, node.WorldZ)
+	}
+}
+
+// flow fields ignore creatures, other shapes change them
+func (grid *Grid) shapeChanged(shapeIndex int) {
+	if shapes.Shapes[shapeIndex].IsSaved {
+		grid.generation++
+	}
+}
+
+func (grid *Grid) SetShape(worldX, worldY, worldZ int, shapeIndex int) *Cell {
+	if block := grid.Source.GetPos(worldX, worldY, worldZ).Block; block > 0 {
+		grid.shapeChanged(block - 1)
+	}
+	grid.shapeChanged(shapeIndex)
+	grid.Source.SetShape(worldX, worldY, worldZ, shapeIndex)
+	viewX, viewY, viewZ, validPos := grid.ToViewPos(worldX, worldY, worldZ)
+	if validPos {
+		cell := grid.Cells[viewX][viewY][viewZ]
+		grid.setPos(cell, grid.Source.GetPos(worldX, worldY, worldZ))
+		if grid.observer != nil {
+			grid.observer.CellChanged(cell)
+		}
+		return cell
+	}
+	return nil
+}
+
+// move the shape at an origin to a new origin, with its layers and variant
+func (grid *Grid) relocate(worldX, worldY, worldZ, newWorldX, newWorldY, newWorldZ int) *Cell {
+	pos := grid.Source.GetPos(worldX, worldY, worldZ)
+	layers := pos.Layers
+	variant := pos.Variant
+	cell, shapeIndex := grid.eraseShapeExact(worldX, worldY, worldZ)
+	if cell == nil {
+		return nil
+	}
+	grid.Source.SetLayers(newWorldX, newWorldY, newWorldZ, layers)
+	grid.Source.GetPos(newWorldX, newWorldY, newWorldZ).Variant = variant
+	newCell := grid.SetShape(newWorldX, newWorldY, newWorldZ, shapeIndex)
+	if newCell != nil && grid.observer != nil {
+		grid.observer.CellMoved(newCell, worldX, worldY, worldZ)
+	}
+	return newCell
+}
+
+func (grid *Grid) EraseShapeExact(worldX, worldY, worldZ int) (*Cell, int) {
+	cell, shapeIndex := grid.eraseShapeExact(worldX, worldY, worldZ)
+	if cell != nil {
+		grid.settle(cell.Box)
+	}
+	return cell, shapeIndex
+}
+
+func (grid *Grid) eraseShapeExact(worldX, worldY, worldZ int) (*Cell, int) {
+	viewX, viewY, viewZ, validPos := grid.ToViewPos(worldX, worldY, worldZ)
+	if validPos {
+		cell := grid.Cells[viewX][viewY][viewZ]
+		if cell.Pos.Block > 0 {
+			shapeIndex := cell.Pos.Block - 1
+			grid.Source.EraseShape(worldX, worldY, worldZ)
+			grid.shapeChanged(shapeIndex)
+			return cell, shapeIndex
+		}
+	}
+	return nil, 0
+}
+
+func (grid *Grid) EraseShape(worldX, worldY, worldZ int) (*Cell, int) {
+	if shapeIndex, ox, oy, oz, hasShape := grid.GetShape(worldX, worldY, worldZ); hasShape {
+		originViewX, originViewY, originViewZ, _ := grid.ToViewPos(ox, oy, oz)
+		box := grid.Cells[originViewX][originViewY][originViewZ].Box
+		grid.Source.EraseShape(ox, oy, oz)
+		grid.shapeChanged(shapeIndex)
+		grid.settle(box)
+		viewX, viewY, viewZ, validPos := grid.ToViewPos(worldX, worldY, worldZ)
+		if validPos {
+			return grid.Cells[viewX][viewY][viewZ], shapeIndex
+		}
+	}
+
+	// sometimes this is called for a shape (creature) no longer in view
+	// assume the position is its origin and remove it from the sector
+	grid.Source.EraseShape(worldX, worldY, worldZ)
+	return nil, 0
+}
@@ -0,0 +1,523 @@
+package spatial
+
+import (
+	"testing"
+
+	"github.com/uzudil/isongn/shapes"
+	"github.com/uzudil/isongn/util"
+	"github.com/uzudil/isongn/world"
+)
+
+// an in-memory world with its center placed so that world and grid positions are the same
+type testSource struct {
+	pos map[[3]int]*world.SectionPosition
+}
+
+func (source *testSource) GetCenter() (int, int) {
+	return SIZE / 2, SIZE / 2
+}
+
+func (source *testSource) GetPos(x, y, z int) *world.SectionPosition {
+	key := [3]int{x, y, z}
+	pos, ok := source.pos[key]
+	if !ok {
+		pos = &world.SectionPosition{}
+		source.pos[key] = pos
+	}
+	return pos
+}
+
+func (source *testSource) SetShape(x, y, z int, shapeIndex int) bool {
+	source.GetPos(x, y, z).Block = shapeIndex + 1
+	return true
+}
+
+func (source *testSource) EraseShape(x, y, z int) bool {
+	source.GetPos(x, y, z).Block = 0
+	return true
+}
+
+func (source *testSource) SetLayers(x, y, z int, layers []int) {
+	source.GetPos(x, y, z).Layers = layers
+}
+
+func addTestShape(name string, w, h, d float32, noSupport bool) *shapes.Shape {
+	if index, ok := shapes.Names[name]; ok {
+		return shapes.Shapes[index]
+	}
+	shape := &shapes.Shape{
+		Index:     len(shapes.Shapes),
+		Name:      name,
+		Size:      [3]float32{w, h, d},
+		NoSupport: noSupport,
+		IsSaved:   true,
+		PathCost:  1,
+	}
+	shapes.Names[name] = shape.Index
+	shapes.Shapes = append(shapes.Shapes, shape)
+	return shape
+}
+
+var (
+	testMover = addTestShape("test.mover", 1, 1, 2, false)
+	testBlock = addTestShape("test.block", 1, 1, 1, false)
+	testWall  = addTestShape("test.wall", 1, 1, 4, false)
+	testWater = addTestShape("test.water", 1, 1, 1, true)
+	testDoor  = addTestShape("test.door", 1, 1, 4, false)
+	testCrate = addTestShape("test.crate", 1, 1, 2, false)
+	testNpc   = addTestShape("test.npc", 1, 1, 2, false)
+	testRoof  = addTestShape("test.roof", 1, 1, 1, false)
+	testBig   = addTestShape("test.big", 2, 2, 2, false)
+)
+
+func init() {
+	testCrate.IsDraggable = true
+	testNpc.IsSaved = false
+	testRoof.Group = 2
+}
+
+func newTestGrid(t *testing.T, place map[[3]int]*shapes.Shape) *Grid {
+	grid := NewGrid(&testSource{pos: map[[3]int]*world.SectionPosition{}}, nil, nil, nil)
+	grid.Load()
+	for pos, shape := range place {
+		if grid.SetShape(pos[0], pos[1], pos[2], shape.Index) == nil {
+			t.Fatalf("can't place %s at %v", shape.Name, pos)
+		}
+	}
+	return grid
+}
+
+func TestMoveShapeOnFlatGround(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testMover,
+	})
+	if z := grid.MoveShape(10, 10, 0, 11, 10, false); z != 0 {
+		t.Fatalf("expected z=0, got %d", z)
+	}
+	if shapeIndex, _, _, _, ok := grid.GetShape(11, 10, 0); !ok || shapeIndex != testMover.Index {
+		t.Fatal("mover not at its new position")
+	}
+	if _, _, _, _, ok := grid.GetShape(10, 10, 0); ok {
+		t.Fatal("mover still at its old position")
+	}
+}
+
+func TestMoveShapeStepUp(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testMover,
+		{11, 10, 0}: testBlock,
+		{12, 10, 0}: testBlock,
+		{12, 10, 1}: testBlock,
+	})
+	if z := grid.MoveShape(10, 10, 0, 11, 10, false); z != 1 {
+		t.Fatalf("expected to step up to z=1, got %d", z)
+	}
+	if z := grid.MoveShape(11, 10, 1, 12, 10, false); z != 2 {
+		t.Fatalf("expected to step up to z=2, got %d", z)
+	}
+}
+
+func TestMoveShapeStepUpTooHigh(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testMover,
+		{11, 10, 0}: testBlock,
+		{11, 10, 1}: testBlock,
+	})
+	if z := grid.MoveShape(10, 10, 0, 11, 10, false); z != -1 {
+		t.Fatalf("expected to be blocked, got z=%d", z)
+	}
+}
+
+func TestMoveShapeDropDown(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testBlock,
+		{10, 10, 1}: testBlock,
+		{10, 10, 2}: testBlock,
+		{10, 10, 3}: testMover,
+		{11, 10, 0}: testBlock,
+	})
+	if z := grid.MoveShape(10, 10, 3, 11, 10, false); z != 1 {
+		t.Fatalf("expected to drop down to z=1, got %d", z)
+	}
+}
+
+func TestMoveShapeNoSupport(t *testing.T) {
+	place := map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testBlock,
+		{10, 10, 1}: testMover,
+		{11, 10, 0}: testWater,
+	}
+	grid := newTestGrid(t, place)
+	if z := grid.MoveShape(10, 10, 1, 11, 10, false); z != -1 {
+		t.Fatalf("expected water to block walking, got z=%d", z)
+	}
+	grid = newTestGrid(t, place)
+	if z := grid.MoveShape(10, 10, 1, 11, 10, true); z != 1 {
+		t.Fatalf("expected to fly over water at z=1, got %d", z)
+	}
+}
+
+func TestFindTopAndIsEmpty(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testWall,
+	})
+	if z := grid.FindTop(10, 10, testBlock, world.SECTION_Z_SIZE); z != 4 {
+		t.Fatalf("expected top at z=4, got %d", z)
+	}
+	if grid.IsEmpty(10, 10, 2, testBlock) {
+		t.Fatal("expected the wall to fill 10,10,2")
+	}
+	if !grid.IsEmpty(10, 10, 4, testBlock) {
+		t.Fatal("expected 10,10,4 to be empty")
+	}
+}
+
+func TestMoveShapeExReasons(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 1}: testMover,
+		{10, 10, 0}: testBlock,
+		{11, 10, 0}: testWater,
+		{10, 11, 0}: testWall,
+		{9, 10, 0}:  testBlock,
+		{9, 10, 1}:  testNpc,
+	})
+	cases := []struct {
+		x, y    int
+		reason  string
+		blocker *shapes.Shape
+		pos     [3]int
+	}{
+		{11, 10, BLOCKED_NOSUPPORT, testWater, [3]int{11, 10, 0}},
+		{10, 11, BLOCKED_WALL, testWall, [3]int{10, 11, 0}},
+		{9, 10, BLOCKED_CREATURE, testNpc, [3]int{9, 10, 1}},
+		{SIZE, 10, BLOCKED_VIEW, nil, [3]int{}},
+	}
+	for _, c := range cases {
+		result := grid.MoveShapeEx(10, 10, 1, c.x, c.y, false, false)
+		if result.Z != -1 || result.Reason != c.reason {
+			t.Fatalf("move to %d,%d: expected %s, got z=%d reason=%q", c.x, c.y, c.reason, result.Z, result.Reason)
+		}
+		if c.blocker == nil {
+			if result.BlockerIndex != -1 {
+				t.Fatalf("move to %d,%d: expected no blocker, got %d", c.x, c.y, result.BlockerIndex)
+			}
+			continue
+		}
+		pos := [3]int{result.BlockerX, result.BlockerY, result.BlockerZ}
+		if result.BlockerIndex != c.blocker.Index || pos != c.pos {
+			t.Fatalf("move to %d,%d: expected %s at %v, got %d at %v", c.x, c.y, c.blocker.Name, c.pos, result.BlockerIndex, pos)
+		}
+	}
+}
+
+func TestMoveShapeExPush(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testMover,
+		{11, 10, 0}: testCrate,
+		{13, 10, 0}: testWall,
+	})
+	if result := grid.MoveShapeEx(10, 10, 0, 11, 10, false, false); result.Z != -1 || result.Pushed {
+		t.Fatal("expected the crate to block without push")
+	}
+	result := grid.MoveShapeEx(10, 10, 0, 11, 10, false, true)
+	if result.Z != 0 || !result.Pushed || result.BlockerX != 12 {
+		t.Fatalf("expected to push the crate to 12,10, got %+v", result)
+	}
+	if shapeIndex, _, _, _, ok := grid.GetShape(12, 10, 0); !ok || shapeIndex != testCrate.Index {
+		t.Fatal("crate not at its new position")
+	}
+
+	// the crate is against the wall now
+	result = grid.MoveShapeEx(11, 10, 0, 12, 10, false, true)
+	if result.Z != -1 || result.Pushed || result.Reason != BLOCKED_WALL || result.BlockerIndex != testCrate.Index {
+		t.Fatalf("expected the crate to be stuck, got %+v", result)
+	}
+}
+
+func TestMoveShapeExPushTwoBlockers(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{9, 9, 0}:   testBig,
+		{11, 9, 0}:  testCrate,
+		{11, 10, 0}: testCrate,
+	})
+	// pushing one crate leaves the other in the way: nothing moves
+	result := grid.MoveShapeEx(9, 9, 0, 10, 9, false, true)
+	if result.Z != -1 || result.Pushed || result.BlockerIndex != testCrate.Index {
+		t.Fatalf("expected the crates to block, got %+v", result)
+	}
+	for _, pos := range [][3]int{{11, 9, 0}, {11, 10, 0}} {
+		if shapeIndex, ox, oy, _, ok := grid.GetShape(pos[0], pos[1], pos[2]); !ok || shapeIndex != testCrate.Index || ox != pos[0] || oy != pos[1] {
+			t.Fatalf("expected a crate to stay at %v", pos)
+		}
+	}
+}
+
+func TestMoveShapeExPushNoSupport(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testBlock,
+		{10, 10, 1}: testMover,
+		{11, 10, 0}: testWater,
+		{11, 10, 1}: testCrate,
+		{12, 10, 0}: testBlock,
+	})
+	// the crate fits on the block, but the mover would stand on the water
+	result := grid.MoveShapeEx(10, 10, 1, 11, 10, false, true)
+	if result.Z != -1 || result.Pushed {
+		t.Fatalf("expected the move to fail, got %+v", result)
+	}
+	if shapeIndex, _, _, _, ok := grid.GetShape(11, 10, 1); !ok || shapeIndex != testCrate.Index {
+		t.Fatal("expected the crate not to move")
+	}
+}
+
+func TestGravity(t *testing.T) {
+	place := map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testBlock,
+		{10, 10, 1}: testBlock,
+		{10, 10, 2}: testCrate,
+		{10, 10, 4}: testBlock,
+		{11, 10, 0}: testWall,
+		{11, 10, 4}: testWater,
+	}
+	grid := newTestGrid(t, place)
+	grid.EraseShape(10, 10, 1)
+	if _, _, _, _, ok := grid.GetShape(10, 10, 1); ok {
+		t.Fatal("expected no falling without gravity")
+	}
+
+	grid = newTestGrid(t, place)
+	grid.SetGravity(true)
+	grid.EraseShape(10, 10, 1)
+	if shapeIndex, _, _, oz, ok := grid.GetShape(10, 10, 1); !ok || shapeIndex != testCrate.Index || oz != 1 {
+		t.Fatal("expected the crate to fall to z=1")
+	}
+	if shapeIndex, _, _, oz, ok := grid.GetShape(10, 10, 3); !ok || shapeIndex != testBlock.Index || oz != 3 {
+		t.Fatal("expected the block on the crate to fall to z=3")
+	}
+	landings := grid.TakeLandings()
+	if len(landings) != 2 || landings[0] != (Landing{testCrate.Index, 10, 10, 1, 2}) || landings[1] != (Landing{testBlock.Index, 10, 10, 3, 4}) {
+		t.Fatalf("unexpected landings %v", landings)
+	}
+	if len(grid.TakeLandings()) != 0 {
+		t.Fatal("expected the landings to be cleared")
+	}
+
+	// NoSupport shapes stay put
+	grid.EraseShape(11, 10, 0)
+	if _, _, _, _, ok := grid.GetShape(11, 10, 4); !ok {
+		t.Fatal("expected the water to stay in place")
+	}
+}
+
+// a room with walls on every side and a door on the east wall
+func newTestRoom(t *testing.T) *Grid {
+	place := map[[3]int]*shapes.Shape{
+		{10, 10, 0}: testMover,
+	}
+	for i := 8; i <= 12; i++ {
+		place[[3]int{i, 8, 0}] = testWall
+		place[[3]int{i, 12, 0}] = testWall
+		place[[3]int{8, i, 0}] = testWall
+		place[[3]int{12, i, 0}] = testWall
+	}
+	place[[3]int{12, 10, 0}] = testDoor
+	return newTestGrid(t, place)
+}
+
+func TestFindPathBlocked(t *testing.T) {
+	grid := newTestRoom(t)
+	options := &PathOptions{Profile: NewMovementProfile(false)}
+	if steps, _ := grid.FindPath(10, 10, 0, 20, 10, 0, 1, 1, options); steps != nil {
+		t.Fatalf("expected no path out of the room, got %v", steps)
+	}
+}
+
+func TestFindPathPassThroughRetry(t *testing.T) {
+	grid := newTestRoom(t)
+	grid.AddPathThroughShape(testDoor)
+	options := &PathOptions{Profile: NewMovementProfile(false)}
+	steps, _ := grid.FindPath(10, 10, 0, 20, 10, 0, 1, 1, options)
+	if steps == nil {
+		t.Fatal("expected a path through the door")
+	}
+	throughDoor := false
+	for _, step := range steps {
+		if step == (PathStep{12, 10, 0}) {
+			throughDoor = true
+		}
+	}
+	if !throughDoor {
+		t.Fatalf("expected the path to pass the door, got %v", steps)
+	}
+
+	// the profile's pass-through shapes replace the grid's
+	options.Profile.PassThrough = map[*shapes.Shape]bool{}
+	if steps, _ := grid.FindPath(10, 10, 0, 20, 10, 0, 1, 1, options); steps != nil {
+		t.Fatalf("expected no path with an empty pass-through set, got %v", steps)
+	}
+}
+
+func TestFindPathPrefersOpenWay(t *testing.T) {
+	grid := newTestRoom(t)
+	grid.AddPathThroughShape(testDoor)
+	grid.EraseShape(10, 8, 0)
+	options := &PathOptions{Profile: NewMovementProfile(false)}
+	steps, _ := grid.FindPath(10, 10, 0, 20, 10, 0, 1, 1, options)
+	if steps == nil {
+		t.Fatal("expected a path")
+	}
+	for _, step := range steps {
+		if step == (PathStep{12, 10, 0}) {
+			t.Fatalf("expected the path to avoid the door when there is an opening, got %v", steps)
+		}
+	}
+}
+
+func TestRequestPathAfterEdit(t *testing.T) {
+	grid := newTestRoom(t)
+	grid.EraseShape(10, 8, 0)
+	handle := grid.RequestPath(10, 10, 0, 20, 10, 0, 1, 1, &PathOptions{Profile: NewMovementProfile(false)}, false)
+	request := grid.PollPath(handle)
+	if grid.stepRequest(request, 10) {
+		t.Fatal("expected the search to take more than one step")
+	}
+	// close the opening mid-search
+	grid.SetShape(10, 8, 0, testWall.Index)
+	for !grid.stepRequest(request, 10) {
+	}
+	if request.Steps != nil {
+		t.Fatalf("expected no path after the opening was closed, got %v", request.Steps)
+	}
+}
+
+func manhattan(a, b PathStep) int {
+	return util.AbsInt(a[0]-b[0]) + util.AbsInt(a[1]-b[1])
+}
+
+func TestFlowStepChaseAndFlee(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{})
+	target := PathStep{20, 10, 0}
+	handle := grid.CreateFlowField(target[0], target[1], target[2], 8, 1, &PathOptions{Profile: NewMovementProfile(false)})
+	step, ok := grid.FlowStep(handle, 15, 10, 0, false)
+	if !ok || step != (PathStep{16, 10, 0}) {
+		t.Fatalf("expected to chase to 16,10,0, got %v %t", step, ok)
+	}
+	if _, ok := grid.FlowStep(handle, 20, 10, 0, false); ok {
+		t.Fatal("expected no step at the target")
+	}
+	from := PathStep{17, 10, 0}
+	step, ok = grid.FlowStep(handle, from[0], from[1], from[2], true)
+	if !ok || manhattan(step, target) <= manhattan(from, target) {
+		t.Fatalf("expected to flee away from the target, got %v %t", step, ok)
+	}
+}
+
+func TestFlowFieldRebuild(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{})
+	handle := grid.CreateFlowField(20, 10, 0, 8, 1, &PathOptions{Profile: NewMovementProfile(false)})
+	if step, ok := grid.FlowStep(handle, 18, 10, 0, false); !ok || step != (PathStep{19, 10, 0}) {
+		t.Fatalf("expected to step to 19,10,0, got %v %t", step, ok)
+	}
+	grid.SetShape(19, 10, 0, testWall.Index)
+	step, ok := grid.FlowStep(handle, 18, 10, 0, false)
+	if !ok || step[0] != 18 {
+		t.Fatalf("expected to go around the new wall, got %v %t", step, ok)
+	}
+
+	// creatures don't change the field
+	generation := grid.generation
+	grid.SetShape(15, 15, 0, testNpc.Index)
+	if grid.generation != generation {
+		t.Fatal("expected a creature not to change the grid's generation")
+	}
+}
+
+func TestFlowFieldLedge(t *testing.T) {
+	// a ledge 4 high: creatures can drop off it but can't climb it
+	place := map[[3]int]*shapes.Shape{}
+	for x := 18; x < 26; x++ {
+		for y := 5; y < 16; y++ {
+			place[[3]int{x, y, 0}] = testWall
+		}
+	}
+	grid := newTestGrid(t, place)
+	options := &PathOptions{Profile: NewMovementProfile(false)}
+
+	up := grid.CreateFlowField(21, 10, 4, 8, 1, options)
+	if step, ok := grid.FlowStep(up, 15, 10, 0, false); ok {
+		t.Fatalf("expected no way up the ledge, got %v", step)
+	}
+	if step, ok := grid.FlowStep(up, 19, 10, 4, false); !ok || step != (PathStep{20, 10, 4}) {
+		t.Fatalf("expected to walk on the ledge to 20,10,4, got %v %t", step, ok)
+	}
+
+	down := grid.CreateFlowField(15, 10, 0, 8, 1, options)
+	if step, ok := grid.FlowStep(down, 18, 10, 4, false); !ok || step != (PathStep{17, 10, 0}) {
+		t.Fatalf("expected to drop off the ledge to 17,10,0, got %v %t", step, ok)
+	}
+}
+
+func newRayOptions() *RayOptions {
+	return &RayOptions{Ignore: map[*shapes.Shape]bool{}, IgnoreGroups: map[int]bool{}}
+}
+
+func TestRaycastHitsWall(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{15, 10, 0}: testWall,
+	})
+	hit, inView := grid.Raycast(10, 10, 1, 20, 10, 1, newRayOptions())
+	if !inView || hit == nil {
+		t.Fatalf("expected the wall to block the ray, got %v %t", hit, inView)
+	}
+	if hit.ShapeIndex != testWall.Index || hit.X != 15 || hit.HitX != 15 || hit.HitZ != 1 {
+		t.Fatalf("expected to hit the wall at 15,10,1, got %+v", hit)
+	}
+	// DIR_W faces +x
+	if !grid.CanSee(10, 10, 1, shapes.DIR_W, 90, 20, 14, 10, 1, newRayOptions()) {
+		t.Fatal("expected to see the position in front of the wall")
+	}
+	if grid.CanSee(10, 10, 1, shapes.DIR_W, 90, 20, 20, 10, 1, newRayOptions()) {
+		t.Fatal("expected the wall to block the view")
+	}
+}
+
+func TestRaycastClearLine(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{15, 12, 0}: testWall,
+		// the shapes at the ends don't block
+		{10, 10, 0}: testMover,
+		{20, 10, 0}: testNpc,
+	})
+	if hit, inView := grid.Raycast(10, 10, 1, 20, 10, 1, newRayOptions()); !inView || hit != nil {
+		t.Fatalf("expected a clear line, got %v %t", hit, inView)
+	}
+}
+
+func TestRaycastOutsideView(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{})
+	if _, inView := grid.Raycast(10, 10, 1, SIZE+10, 10, 1, newRayOptions()); inView {
+		t.Fatal("expected the end to be outside the view")
+	}
+	if grid.CanSee(10, 10, 1, shapes.DIR_W, 360, 1000, SIZE+10, 10, 1, newRayOptions()) {
+		t.Fatal("expected not to see a position outside the view")
+	}
+}
+
+func TestRaycastIgnore(t *testing.T) {
+	grid := newTestGrid(t, map[[3]int]*shapes.Shape{
+		{13, 10, 1}: testRoof,
+		{16, 10, 0}: testWall,
+	})
+	options := newRayOptions()
+	if hit, _ := grid.Raycast(10, 10, 1, 20, 10, 1, options); hit == nil || hit.ShapeIndex != testRoof.Index {
+		t.Fatalf("expected to hit the roof first, got %+v", hit)
+	}
+	options.IgnoreGroups[testRoof.Group] = true
+	if hit, _ := grid.Raycast(10, 10, 1, 20, 10, 1, options); hit == nil || hit.ShapeIndex != testWall.Index {
+		t.Fatalf("expected to pass the roof group and hit the wall, got %+v", hit)
+	}
+	options.Ignore[testWall] = true
+	if hit, inView := grid.Raycast(10, 10, 1, 20, 10, 1, options); !inView || hit != nil {
+		t.Fatalf("expected to pass the ignored shapes, got %+v %t", hit, inView)
+	}
+}
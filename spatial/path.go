@@ -0,0 +1,536 @@
+package spatial
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/uzudil/isongn/shapes"
+	"github.com/uzudil/isongn/world"
+)
+
+const (
+	COST_STRAIGHT = 10
+	COST_DIAGONAL = 14
+	// max nodes expanded per frame for all path requests
+	PATH_BUDGET = 2000
+	// seconds a finished path request is kept around for polling
+	PATH_RESULT_TTL = 10
+)
+
+type PathStep [3]int
+
+// MovementProfile describes how a shape moves
+type MovementProfile struct {
+	IsFlying bool
+	// shapes to path through (doors, etc.) if there is no other way, nil uses the shapes from AddPathThroughShape
+	PassThrough map[*shapes.Shape]bool
+	// shapes never passed through or stood on
+	Blocking map[*shapes.Shape]bool
+	// how high the shape can step up
+	MaxStep int
+}
+
+func NewMovementProfile(isFlying bool) *MovementProfile {
+	return &MovementProfile{
+		IsFlying: isFlying,
+		Blocking: map[*shapes.Shape]bool{},
+		MaxStep:  1,
+	}
+}
+
+type PathOptions struct {
+	Profile *MovementProfile
+	// allow 8-way movement
+	Diagonal bool
+	// path cost overrides by shape index, replacing Shape.PathCost
+	Costs map[int]float32
+}
+
+// a node of an A* search
+type PathNode struct {
+	pos             *Cell
+	f, g, h         int
+	visited, closed bool
+	parent          *PathNode
+	heapIndex       int
+}
+
+type ViewContext struct {
+	profile           *MovementProfile
+	isPathing         bool
+	usePathThrough    bool
+	pathThroughShapes map[*shapes.Shape]bool
+	start, end        *Cell
+	search            *pathSearch
+	// collision box to use instead of start's (for flow fields)
+	box             *BoundingBox
+	ignoreCreatures bool
+	// what stopped the last tryMove
+	blocker   *Cell
+	noSupport bool
+}
+
+// the state of one A* search. It can be advanced a few nodes at a time.
+type pathSearch struct {
+	sx, sy, sz, ex, ey, ez int
+	dSrc, dDst             int
+	options                *PathOptions
+	start, end             *Cell
+	startBox, endBox       *BoundingBox
+	usePathThrough         bool
+	nodes                  map[*Cell]*PathNode
+	blockers               map[*Cell]*Cell
+	openList               pathHeap
+	done                   bool
+	steps                  []PathStep
+	cost                   int
+	// the grid's generation the search started in
+	generation int
+}
+
+func (grid *Grid) AddPathThroughShape(shape *shapes.Shape) {
+	grid.context.pathThroughShapes[shape] = true
+	if grid.Nav != nil {
+		grid.Nav.AddPassThrough(shape)
+	}
+}
+
+// Returns the steps of the path and its total cost (1 per straight step on ground with a pathCost of 1).
+func (grid *Grid) FindPath(sx, sy, sz, ex, ey, ez int, dSrc, dDst int, options *PathOptions) ([]PathStep, float64) {
+	search := grid.newPathSearch(sx, sy, sz, ex, ey, ez, dSrc, dDst, options)
+	search.step(grid, -1)
+	return search.steps, float64(search.cost) / COST_STRAIGHT
+}
+
+// PathRequest is a path search run a bit at a time over several frames
+type PathRequest struct {
+	Handle   int
+	Done     bool
+	Steps    []PathStep
+	Cost     float64
+	Callback bool
+	// for a far request: the coarse waypoints remaining after the end of Steps
+	Waypoints []PathStep
+	search    *pathSearch
+	far       *farSearch
+	ttl       float64
+}
+
+// the coarse part of a far path request
+type farSearch struct {
+	nav        *world.NavSearch
+	sx, sy, sz int
+	dSrc, dDst int
+	options    *PathOptions
+	waypoints  []PathStep
+	// the waypoint the view's search goes to
+	target int
+}
+
+// RequestPath starts a path search and returns a handle to poll it with. The search is advanced by AdvancePaths.
+func (grid *Grid) RequestPath(sx, sy, sz, ex, ey, ez int, dSrc, dDst int, options *PathOptions, callback bool) int {
+	grid.pathHandle++
+	grid.pathRequests[grid.pathHandle] = &PathRequest{
+		Handle:   grid.pathHandle,
+		Callback: callback,
+		search:   grid.newPathSearch(sx, sy, sz, ex, ey, ez, dSrc, dDst, options),
+		ttl:      PATH_RESULT_TTL,
+	}
+	return grid.pathHandle
+}
+
+// RequestPathFar is RequestPath for a destination which may be outside the grid. It plans over the coarse
+// nav grid of the world, then finds a path to the furthest waypoint in view that can be reached. The
+// remaining waypoints are in the request's Waypoints.
+func (grid *Grid) RequestPathFar(sx, sy, sz, ex, ey, ez int, dSrc, dDst int, options *PathOptions, callback bool) int {
+	if grid.Nav == nil || (grid.InView(sx, sy, sz) && grid.InView(ex, ey, ez)) {
+		handle := grid.RequestPath(sx, sy, sz, ex, ey, ez, dSrc, dDst, options, callback)
+		grid.pathRequests[handle].Waypoints = []PathStep{}
+		return handle
+	}
+	profile := options.Profile
+	grid.pathHandle++
+	grid.pathRequests[grid.pathHandle] = &PathRequest{
+		Handle:   grid.pathHandle,
+		Callback: callback,
+		far: &farSearch{
+			nav: grid.Nav.NewSearch(sx, sy, ex, ey, &world.NavProfile{
+				IsFlying:    profile.IsFlying,
+				PassThrough: profile.PassThrough,
+				Blocking:    profile.Blocking,
+				MaxStep:     profile.MaxStep,
+			}),
+			sx: sx, sy: sy, sz: sz,
+			dSrc:    dSrc,
+			dDst:    dDst,
+			options: options,
+		},
+		ttl: PATH_RESULT_TTL,
+	}
+	return grid.pathHandle
+}
+
+// PollPath returns the path request or nil if it is unknown, cancelled or expired
+func (grid *Grid) PollPath(handle int) *PathRequest {
+	return grid.pathRequests[handle]
+}
+
+func (grid *Grid) CancelPath(handle int) {
+	delete(grid.pathRequests, handle)
+}
+
+// AdvancePaths runs the pending path searches for up to PATH_BUDGET node expansions, shared evenly.
+// Returns the requests that finished and asked for a callback.
+func (grid *Grid) AdvancePaths(delta float64) []*PathRequest {
+	handles := []int{}
+	pending := 0
+	for handle, request := range grid.pathRequests {
+		if request.Done {
+			request.ttl -= delta
+			if request.ttl <= 0 {
+				delete(grid.pathRequests, handle)
+			}
+		} else {
+			handles = append(handles, handle)
+			pending++
+		}
+	}
+	finished := []*PathRequest{}
+	if pending == 0 {
+		return finished
+	}
+	sort.Ints(handles)
+	budget := PATH_BUDGET / pending
+	if budget < 1 {
+		budget = 1
+	}
+	for _, handle := range handles {
+		request := grid.pathRequests[handle]
+		if grid.stepRequest(request, budget) {
+			request.Done = true
+			request.search = nil
+			request.far = nil
+			if request.Callback {
+				finished = append(finished, request)
+			}
+		}
+	}
+	return finished
+}
+
+// returns true when the request is done
+func (grid *Grid) stepRequest(request *PathRequest, budget int) bool {
+	far := request.far
+	if far != nil && request.search == nil {
+		// a coarse cell costs about as much as a row of the view's nodes
+		navBudget := budget / world.NAV_CELL
+		if navBudget < 1 {
+			navBudget = 1
+		}
+		if !far.nav.Step(navBudget) {
+			return false
+		}
+		waypoints := far.nav.Waypoints()
+		far.waypoints = []PathStep{}
+		for _, waypoint := range waypoints {
+			far.waypoints = append(far.waypoints, PathStep(waypoint))
+		}
+		far.target = 0
+		for far.target < len(far.waypoints) && grid.InView(far.waypoints[far.target][0], far.waypoints[far.target][1], far.waypoints[far.target][2]) {
+			far.target++
+		}
+		far.target--
+		if far.target < 0 {
+			return true
+		}
+		request.search = grid.newFarPathSearch(far)
+		return false
+	}
+	if !request.search.step(grid, budget) {
+		return false
+	}
+	if far != nil && request.search.steps == nil && far.target > 0 {
+		// try the waypoint before
+		far.target--
+		request.search = grid.newFarPathSearch(far)
+		return false
+	}
+	request.Steps = request.search.steps
+	request.Cost = float64(request.search.cost) / COST_STRAIGHT
+	if far != nil && request.Steps != nil {
+		request.Waypoints = far.waypoints[far.target+1:]
+	}
+	return true
+}
+
+// a search to the far request's current target waypoint
+func (grid *Grid) newFarPathSearch(far *farSearch) *pathSearch {
+	waypoint := far.waypoints[far.target]
+	d := 1
+	if far.target == len(far.waypoints)-1 {
+		d = far.dDst
+	}
+	return grid.newPathSearch(far.sx, far.sy, far.sz, waypoint[0], waypoint[1], waypoint[2], far.dSrc, d, far.options)
+}
+
+// the view moved: cells now point to other world positions
+func (grid *Grid) restartPathRequests() {
+	for _, request := range grid.pathRequests {
+		if !request.Done && request.search != nil {
+			request.search.restart(grid)
+		}
+	}
+}
+
+func (grid *Grid) newPathSearch(sx, sy, sz, ex, ey, ez int, dSrc, dDst int, options *PathOptions) *pathSearch {
+	search := &pathSearch{
+		sx: sx, sy: sy, sz: sz,
+		ex: ex, ey: ey, ez: ez,
+		dSrc:    dSrc,
+		dDst:    dDst,
+		options: options,
+	}
+	search.restart(grid)
+	return search
+}
+
+// (re)start the search from the world positions, needed after the view moves or the grid changes
+func (search *pathSearch) restart(grid *Grid) {
+	startViewX, startViewY, startViewZ, startOk := grid.ToViewPos(search.sx, search.sy, search.sz)
+	endViewX, endViewY, endViewZ, endOk := grid.ToViewPos(search.ex, search.ey, search.ez)
+	if !startOk || !endOk {
+		search.done = true
+		search.steps = nil
+		search.cost = 0
+		return
+	}
+	search.generation = grid.generation
+	search.done = false
+	search.start = grid.Cells[startViewX][startViewY][startViewZ]
+	search.end = grid.Cells[endViewX][endViewY][endViewZ]
+	search.startBox = &BoundingBox{startViewX, startViewY, startViewZ, search.dSrc, search.dSrc, 4}
+	search.endBox = &BoundingBox{endViewX, endViewY, endViewZ, search.dDst, search.dDst, 4}
+	// first try w/o doors
+	search.reset(false)
+}
+
+func (search *pathSearch) reset(usePathThrough bool) {
+	search.usePathThrough = usePathThrough
+	search.nodes = map[*Cell]*PathNode{}
+	search.blockers = map[*Cell]*Cell{}
+	search.openList = pathHeap{}
+	start := search.node(search.start)
+	start.h = search.heuristic(search.start)
+	start.f = start.h
+	start.visited = true
+	heap.Push(&search.openList, start)
+}
+
+func (search *pathSearch) node(pos *Cell) *PathNode {
+	node, ok := search.nodes[pos]
+	if !ok {
+		node = &PathNode{pos: pos, heapIndex: -1}
+		search.nodes[pos] = node
+	}
+	return node
+}
+
+// A* search over the grid using a binary heap for the open list. Expands at most
+// budget nodes (no limit if budget < 0) and returns true when the search is done.
+// Costs are scaled by 10 so a diagonal step (14) stays an integer.
+func (search *pathSearch) step(grid *Grid, budget int) bool {
+	if search.done {
+		return true
+	}
+	if search.generation != grid.generation {
+		// the grid changed: the cached blockers and expanded nodes are stale
+		search.restart(grid)
+		if search.done {
+			return true
+		}
+	}
+	grid.context.isPathing = true
+	grid.context.profile = search.options.Profile
+	grid.context.usePathThrough = search.usePathThrough
+	grid.context.start = search.start
+	grid.context.end = search.end
+	grid.context.search = search
+	defer func() {
+		grid.context.isPathing = false
+		grid.context.search = nil
+	}()
+
+	for expanded := 0; budget < 0 || expanded < budget; expanded++ {
+		if search.openList.Len() == 0 {
+			if !search.usePathThrough {
+				// try again with doors
+				search.reset(true)
+				grid.context.usePathThrough = true
+				continue
+			}
+			// No result was found -- nil signifies failure to find path
+			search.done = true
+			return true
+		}
+		currentNode := heap.Pop(&search.openList).(*PathNode)
+
+		// End case -- result has been found, return the traced path
+		search.startBox.SetPos(currentNode.pos.X, currentNode.pos.Y, currentNode.pos.Z)
+		if search.startBox.intersect(search.endBox) {
+			search.steps = grid.generatePath(currentNode)
+			search.cost = currentNode.g
+			search.done = true
+			return true
+		}
+		currentNode.closed = true
+
+		for _, neighbor := range search.astarNeighbors(grid, currentNode.pos) {
+			node := search.node(neighbor.node)
+			if node.closed {
+				continue
+			}
+			gScore := currentNode.g + search.stepCost(grid, neighbor.node, neighbor.cost)
+			if !node.visited {
+				node.visited = true
+				node.h = search.heuristic(neighbor.node)
+				node.parent = currentNode
+				node.g = gScore
+				node.f = gScore + node.h
+				heap.Push(&search.openList, node)
+			} else if gScore < node.g {
+				node.parent = currentNode
+				node.g = gScore
+				node.f = gScore + node.h
+				heap.Fix(&search.openList, node.heapIndex)
+			}
+		}
+	}
+	return false
+}
+
+// Distance (in steps) from the start box placed at pos to the end box. Octile if diagonal moves are allowed,
+// Manhattan otherwise. Z is ignored since dropping down or stepping up comes free with a move.
+func (search *pathSearch) heuristic(pos *Cell) int {
+	dx := boxGap(pos.X, search.startBox.W, search.endBox.X, search.endBox.W)
+	dy := boxGap(pos.Y, search.startBox.H, search.endBox.Y, search.endBox.H)
+	if search.options.Diagonal {
+		if dx < dy {
+			dx, dy = dy, dx
+		}
+		return dx*COST_STRAIGHT + dy*(COST_DIAGONAL-COST_STRAIGHT)
+	}
+	return (dx + dy) * COST_STRAIGHT
+}
+
+// The cost of stepping onto node, scaled by the pathCost of the shape it stands on. Costs below 1 make
+// the heuristic overestimate, so the path found may not be the cheapest one.
+func (search *pathSearch) stepCost(grid *Grid, node *Cell, cost int) int {
+	if node.Z == 0 {
+		return cost
+	}
+	ground := grid.getBlockerWithCache(grid.Cells[node.X][node.Y][node.Z-1])
+	if ground == nil {
+		return cost
+	}
+	groundIndex := ground.Pos.Block - 1
+	multiplier, ok := search.options.Costs[groundIndex]
+	if !ok {
+		multiplier = shapes.Shapes[groundIndex].PathCost
+	}
+	return int(float32(cost)*multiplier + 0.5)
+}
+
+func boxGap(a, aw, b, bw int) int {
+	if a+aw <= b {
+		return b - (a + aw) + 1
+	}
+	if a >= b+bw {
+		return a - (b + bw) + 1
+	}
+	return 0
+}
+
+type pathNeighbor struct {
+	node *Cell
+	cost int
+}
+
+func (search *pathSearch) astarNeighbors(grid *Grid, node *Cell) []pathNeighbor {
+	ret := []pathNeighbor{}
+	var straight [3][3]bool
+	for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		if grid.IsValidViewPos(node.X+d[0], node.Y+d[1], node.Z) {
+			if newNode := grid.tryInDir(node, d[0], d[1]); newNode != nil {
+				ret = append(ret, pathNeighbor{newNode, COST_STRAIGHT})
+				straight[d[0]+1][d[1]+1] = true
+			}
+		}
+	}
+	if search.options.Diagonal {
+		for _, d := range [][2]int{{-1, -1}, {1, -1}, {-1, 1}, {1, 1}} {
+			// no corner cutting: both orthogonal moves have to be open
+			if straight[d[0]+1][1] && straight[1][d[1]+1] && grid.IsValidViewPos(node.X+d[0], node.Y+d[1], node.Z) {
+				if newNode := grid.tryInDir(node, d[0], d[1]); newNode != nil {
+					ret = append(ret, pathNeighbor{newNode, COST_DIAGONAL})
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func (grid *Grid) tryInDir(node *Cell, dx, dy int) *Cell {
+	return grid.tryMove(node.X+dx, node.Y+dy, node.Z)
+}
+
+func (grid *Grid) generatePath(currentNode *PathNode) []PathStep {
+	ret := []PathStep{}
+	for currentNode.parent != nil {
+		wx, wy, wz := grid.ToWorldPos(currentNode.pos.X, currentNode.pos.Y, currentNode.pos.Z)
+		ret = append(ret, PathStep{wx, wy, wz})
+		currentNode = currentNode.parent
+	}
+	return reverse(ret)
+}
+
+// open list ordered by f, see container/heap
+type pathHeap []*PathNode
+
+func (h pathHeap) Len() int { return len(h) }
+
+func (h pathHeap) Less(i, j int) bool {
+	if h[i].f == h[j].f {
+		return h[i].h < h[j].h
+	}
+	return h[i].f < h[j].f
+}
+
+func (h pathHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *pathHeap) Push(x interface{}) {
+	node := x.(*PathNode)
+	node.heapIndex = len(*h)
+	*h = append(*h, node)
+}
+
+func (h *pathHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	node := old[n-1]
+	old[n-1] = nil
+	node.heapIndex = -1
+	*h = old[:n-1]
+	return node
+}
+
+func reverse(nodes []PathStep) []PathStep {
+	for i := 0; i < len(nodes)/2; i++ {
+		j := len(nodes) - i - 1
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	return nodes
+}
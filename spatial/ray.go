@@ -0,0 +1,119 @@
+package spatial
+
+import (
+	"math"
+
+	"github.com/uzudil/isongn/shapes"
+)
+
+type RayOptions struct {
+	// shapes the ray passes through
+	Ignore map[*shapes.Shape]bool
+	// shape groups the ray passes through (roofs, etc.)
+	IgnoreGroups map[int]bool
+}
+
+// RayHit is the first shape blocking a ray
+type RayHit struct {
+	ShapeIndex int
+	// the origin of the blocking shape
+	X, Y, Z int
+	// the position where the ray hit it
+	HitX, HitY, HitZ int
+}
+
+// Raycast walks the positions from the start to the end position (3D DDA through the centers of the positions)
+// and returns the first blocking shape, or nil if the end is reached. The shapes at the start and the end positions
+// never block. The second return value is false if the start or the end is outside the view: nothing is known
+// about the line then.
+func (grid *Grid) Raycast(sx, sy, sz, ex, ey, ez int, options *RayOptions) (*RayHit, bool) {
+	startViewX, startViewY, startViewZ, startOk := grid.ToViewPos(sx, sy, sz)
+	endViewX, endViewY, endViewZ, endOk := grid.ToViewPos(ex, ey, ez)
+	if !startOk || !endOk {
+		return nil, false
+	}
+	source := grid.GetShapeAt(startViewX, startViewY, startViewZ)
+	target := grid.GetShapeAt(endViewX, endViewY, endViewZ)
+
+	pos := [3]int{startViewX, startViewY, startViewZ}
+	end := [3]int{endViewX, endViewY, endViewZ}
+	var step [3]int
+	var tMax, tDelta [3]float64
+	for i := 0; i < 3; i++ {
+		d := float64(end[i] - pos[i])
+		switch {
+		case d > 0:
+			step[i] = 1
+		case d < 0:
+			step[i] = -1
+		}
+		if d == 0 {
+			tMax[i] = math.Inf(1)
+			tDelta[i] = math.Inf(1)
+		} else {
+			// the ray starts at the center of the position: the first boundary is half a position away
+			tDelta[i] = math.Abs(1 / d)
+			tMax[i] = tDelta[i] / 2
+		}
+	}
+
+	for pos != end {
+		// advance along the axis with the nearest boundary
+		axis := 0
+		if tMax[1] < tMax[axis] {
+			axis = 1
+		}
+		if tMax[2] < tMax[axis] {
+			axis = 2
+		}
+		pos[axis] += step[axis]
+		tMax[axis] += tDelta[axis]
+		if !grid.IsValidViewPos(pos[0], pos[1], pos[2]) {
+			return nil, false
+		}
+
+		var blocker *Cell
+		grid.search(pos[0], pos[1], pos[2], func(bp *Cell) bool {
+			if bp == source || bp == target || !bp.Box.isInside(pos[0], pos[1], pos[2]) {
+				return false
+			}
+			shape := shapes.Shapes[bp.Pos.Block-1]
+			if options.Ignore[shape] || options.IgnoreGroups[shape.Group] {
+				return false
+			}
+			blocker = bp
+			return true
+		})
+		if blocker != nil {
+			ox, oy, oz := grid.ToWorldPos(blocker.X, blocker.Y, blocker.Z)
+			hx, hy, hz := grid.ToWorldPos(pos[0], pos[1], pos[2])
+			return &RayHit{blocker.Pos.Block - 1, ox, oy, oz, hx, hy, hz}, true
+		}
+	}
+	return nil, true
+}
+
+// CanSee checks if the end position is within distance and inside the cone of fov degrees around dir,
+// looking from the start position, and that nothing blocks the line. False if either position is outside the view.
+func (grid *Grid) CanSee(sx, sy, sz int, dir shapes.Direction, fov, distance float64, ex, ey, ez int, options *RayOptions) bool {
+	tx := float64(ex - sx)
+	ty := float64(ey - sy)
+	tz := float64(ez - sz)
+	length := math.Sqrt(tx*tx + ty*ty + tz*tz)
+	if length > distance {
+		return false
+	}
+	if length > 0 {
+		dx, dy := dir.GetDelta()
+		dirLength := math.Sqrt(float64(dx*dx + dy*dy))
+		targetLength := math.Sqrt(tx*tx + ty*ty)
+		if dirLength > 0 && targetLength > 0 {
+			cos := (float64(dx)*tx + float64(dy)*ty) / (dirLength * targetLength)
+			if cos < math.Cos(fov/2*math.Pi/180) {
+				return false
+			}
+		}
+	}
+	hit, inView := grid.Raycast(sx, sy, sz, ex, ey, ez, options)
+	return inView && hit == nil
+}
@@ -108,6 +108,10 @@ func ToBscriptMap(d map[string]interface{}) *bscript.Map {
 	return m
 }
 
+func ToBscriptArray(a *[]interface{}) *bscript.Array {
+	return toValue(a).Array
+}
+
 func Linear(a, b, percent float32) float32 {
 	return a + (b-a)*percent
 }
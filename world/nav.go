@@ -0,0 +1,507 @@
+package world
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/uzudil/isongn/shapes"
+)
+
+const (
+	// size of a coarse navigation cell in world units
+	NAV_CELL = 8
+	// free space needed above the floor to walk there
+	NAV_HEADROOM = 4
+	// give up after expanding this many coarse cells
+	NAV_MAX_NODES = 50000
+	// max number of sections kept in the nav cache
+	NAV_MAX_SECTIONS = 64
+	navBlocked       = -1
+)
+
+// NavProfile is how a coarse path moves, see spatial.MovementProfile
+type NavProfile struct {
+	IsFlying bool
+	// shapes that don't block, nil uses the shapes from AddPassThrough
+	PassThrough map[*shapes.Shape]bool
+	// shapes never passed through or stood on
+	Blocking map[*shapes.Shape]bool
+	// how high a step up can be
+	MaxStep int
+}
+
+// the profile's settings that change the floors of a section
+func (profile *NavProfile) key() string {
+	indexes := func(m map[*shapes.Shape]bool) []int {
+		r := []int{}
+		for shape, ok := range m {
+			if ok {
+				r = append(r, shape.Index)
+			}
+		}
+		sort.Ints(r)
+		return r
+	}
+	passThrough := "default"
+	if profile.PassThrough != nil {
+		passThrough = fmt.Sprint(indexes(profile.PassThrough))
+	}
+	return fmt.Sprintf("%t %s %v", profile.IsFlying, passThrough, indexes(profile.Blocking))
+}
+
+// floor heights of every column of a section, or navBlocked
+type navSection struct {
+	floor [SECTION_SIZE][SECTION_SIZE]int8
+}
+
+type navKey struct {
+	sx, sy  int
+	profile string
+}
+
+// NavGrid is a coarse connectivity grid built from the stored sections. It is used to plan paths
+// much longer than the view; the result is a list of waypoints to be refined by the view's A*.
+// Built sections are kept until the section is edited or saved (see Invalidate).
+type NavGrid struct {
+	loader      *Loader
+	sections    map[navKey]*navSection
+	passThrough map[*shapes.Shape]bool
+	// set when a section was read from disk
+	didRead bool
+}
+
+func NewNavGrid(loader *Loader) *NavGrid {
+	return &NavGrid{
+		loader:      loader,
+		sections:    map[navKey]*navSection{},
+		passThrough: map[*shapes.Shape]bool{},
+	}
+}
+
+// shapes (like doors) that don't block coarse paths
+func (nav *NavGrid) AddPassThrough(shape *shapes.Shape) {
+	nav.passThrough[shape] = true
+	nav.sections = map[navKey]*navSection{}
+}
+
+// Invalidate drops the built section and the ones its shapes can reach into, they're rebuilt
+// when a path needs them
+func (nav *NavGrid) Invalidate(sx, sy int) {
+	for key := range nav.sections {
+		if (key.sx == sx || key.sx == sx+1) && (key.sy == sy || key.sy == sy+1) {
+			delete(nav.sections, key)
+		}
+	}
+}
+
+func (nav *NavGrid) getSection(sx, sy int, profile *NavProfile, profileKey string) *navSection {
+	key := navKey{sx, sy, profileKey}
+	if ns, ok := nav.sections[key]; ok {
+		return ns
+	}
+	section, cached, err := nav.loader.ReadSection(sx, sy)
+	if !cached {
+		nav.didRead = true
+	}
+	var ns *navSection
+	if err != nil {
+		fmt.Printf("Can't read section %d,%d for navigation: %v\n", sx, sy, err)
+		ns = &navSection{}
+		for x := range ns.floor {
+			for y := range ns.floor[x] {
+				ns.floor[x][y] = navBlocked
+			}
+		}
+	} else {
+		ns = nav.build(section, profile)
+	}
+	if len(nav.sections) >= NAV_MAX_SECTIONS {
+		nav.sections = map[navKey]*navSection{}
+	}
+	nav.sections[key] = ns
+	return ns
+}
+
+func (nav *NavGrid) build(section *Section, profile *NavProfile) *navSection {
+	occupied := new([SECTION_SIZE][SECTION_SIZE][SECTION_Z_SIZE]bool)
+	noSupport := new([SECTION_SIZE][SECTION_SIZE][SECTION_Z_SIZE]bool)
+	// shapes extend to +x and +y, so the sections to the -x and -y can reach into this one
+	maxSize := 0
+	for _, shape := range shapes.Shapes {
+		if shape == nil {
+			continue
+		}
+		for _, size := range shape.Size[:2] {
+			if n := int(math.Ceil(float64(size))); n > maxSize {
+				maxSize = n
+			}
+		}
+	}
+	for _, d := range [][2]int{{0, 0}, {-1, 0}, {0, -1}, {-1, -1}} {
+		other := section
+		if d != [2]int{0, 0} {
+			if section.X+d[0] < 0 || section.Y+d[1] < 0 {
+				continue
+			}
+			var err error
+			var cached bool
+			other, cached, err = nav.loader.ReadSection(section.X+d[0], section.Y+d[1])
+			if !cached {
+				nav.didRead = true
+			}
+			if err != nil {
+				fmt.Printf("Can't read section %d,%d for navigation: %v\n", section.X+d[0], section.Y+d[1], err)
+				continue
+			}
+		}
+		nav.stamp(other, d[0]*SECTION_SIZE, d[1]*SECTION_SIZE, maxSize, profile, occupied, noSupport)
+	}
+
+	ns := &navSection{}
+	for x := 0; x < SECTION_SIZE; x++ {
+		for y := 0; y < SECTION_SIZE; y++ {
+			floor := 0
+			for floor < SECTION_Z_SIZE && occupied[x][y][floor] {
+				floor++
+			}
+			blocked := floor == 0 || floor >= SECTION_Z_SIZE || noSupport[x][y][floor-1]
+			for z := floor; !blocked && z < floor+NAV_HEADROOM && z < SECTION_Z_SIZE; z++ {
+				blocked = occupied[x][y][z]
+			}
+			if blocked {
+				ns.floor[x][y] = navBlocked
+			} else {
+				ns.floor[x][y] = int8(floor)
+			}
+		}
+	}
+	return ns
+}
+
+// mark the space taken by the shapes of a section whose origin is at ox, oy relative to the one being built
+func (nav *NavGrid) stamp(section *Section, ox, oy, maxSize int, profile *NavProfile, occupied, noSupport *[SECTION_SIZE][SECTION_SIZE][SECTION_Z_SIZE]bool) {
+	minX, minY := 0, 0
+	if ox < 0 && maxSize < SECTION_SIZE {
+		minX = SECTION_SIZE - maxSize
+	}
+	if oy < 0 && maxSize < SECTION_SIZE {
+		minY = SECTION_SIZE - maxSize
+	}
+	for x := minX; x < SECTION_SIZE; x++ {
+		for y := minY; y < SECTION_SIZE; y++ {
+			for z := 0; z < SECTION_Z_SIZE; z++ {
+				block := section.Pos[x][y][z].Block
+				if block == 0 {
+					continue
+				}
+				shape := shapes.Shapes[block-1]
+				if !shape.IsSaved || nav.isPassThrough(shape, profile) {
+					continue
+				}
+				w := int(math.Ceil(float64(shape.Size[0])))
+				h := int(math.Ceil(float64(shape.Size[1])))
+				d := int(math.Ceil(float64(shape.Size[2])))
+				for xx := x + ox; xx < x+ox+w && xx < SECTION_SIZE; xx++ {
+					for yy := y + oy; yy < y+oy+h && yy < SECTION_SIZE; yy++ {
+						if xx < 0 || yy < 0 {
+							continue
+						}
+						for zz := z; zz < z+d && zz < SECTION_Z_SIZE; zz++ {
+							occupied[xx][yy][zz] = true
+							noSupport[xx][yy][zz] = (!profile.IsFlying && shape.NoSupport) || profile.Blocking[shape]
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func (nav *NavGrid) isPassThrough(shape *shapes.Shape, profile *NavProfile) bool {
+	if profile.Blocking[shape] {
+		return false
+	}
+	if profile.PassThrough != nil {
+		return profile.PassThrough[shape]
+	}
+	return nav.passThrough[shape]
+}
+
+// NavSearch is a coarse path search. It can be run a few cells at a time.
+type NavSearch struct {
+	nav        *NavGrid
+	profile    *NavProfile
+	profileKey string
+	end        [2]int
+	startPos   [3]int
+	endPos     [3]int
+	nodes      map[[2]int]*navNode
+	openList   *navHeap
+	expanded   int
+	done       bool
+	waypoints  [][3]int
+}
+
+// NewSearch starts a coarse search between two world positions
+func (nav *NavGrid) NewSearch(sx, sy, ex, ey int, profile *NavProfile) *NavSearch {
+	search := &NavSearch{
+		nav:        nav,
+		profile:    profile,
+		profileKey: profile.key(),
+		end:        [2]int{ex / NAV_CELL, ey / NAV_CELL},
+		startPos:   [3]int{sx, sy, 0},
+		endPos:     [3]int{ex, ey, 0},
+		openList:   &navHeap{},
+	}
+	start := &navNode{cx: sx / NAV_CELL, cy: sy / NAV_CELL}
+	start.f = navDistance(start.cx, start.cy, search.end)
+	search.nodes = map[[2]int]*navNode{{start.cx, start.cy}: start}
+	heap.Push(search.openList, start)
+	return search
+}
+
+// FindPath plans a coarse path between two world positions. It returns waypoints (world x, y, z), one per
+// coarse cell after the start, ending at the destination. Returns nil if there is no path.
+func (nav *NavGrid) FindPath(sx, sy, ex, ey int, profile *NavProfile) [][3]int {
+	search := nav.NewSearch(sx, sy, ex, ey, profile)
+	search.Step(-1)
+	return search.Waypoints()
+}
+
+// Waypoints returns the result of a finished search, nil if there is no path
+func (search *NavSearch) Waypoints() [][3]int {
+	return search.waypoints
+}
+
+// Step expands at most budget cells (no limit if budget < 0) and returns true when the search is done.
+// With a budget, it also stops after reading a section from disk.
+func (search *NavSearch) Step(budget int) bool {
+	if search.done {
+		return true
+	}
+	if search.expanded == 0 {
+		search.startPos[2] = search.floor(search.startPos[0], search.startPos[1])
+		search.endPos[2] = search.floor(search.endPos[0], search.endPos[1])
+		if search.endPos[2] == navBlocked {
+			search.done = true
+			return true
+		}
+	}
+	search.nav.didRead = false
+	for steps := 0; budget < 0 || steps < budget; steps++ {
+		if search.openList.Len() == 0 || search.expanded >= NAV_MAX_NODES {
+			search.done = true
+			return true
+		}
+		search.expanded++
+		node := heap.Pop(search.openList).(*navNode)
+		if node.cx == search.end[0] && node.cy == search.end[1] {
+			search.waypoints = search.toWaypoints(node)
+			search.done = true
+			return true
+		}
+		node.closed = true
+		for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			key := [2]int{node.cx + d[0], node.cy + d[1]}
+			if key[0] < 0 || key[1] < 0 {
+				continue
+			}
+			neighbor, seen := search.nodes[key]
+			if seen && neighbor.closed {
+				continue
+			}
+			if !seen && !search.isOpen(key[0], key[1]) {
+				continue
+			}
+			if !search.isConnected(node.cx, node.cy, d[0], d[1]) {
+				continue
+			}
+			g := node.g + 1
+			if !seen {
+				neighbor = &navNode{cx: key[0], cy: key[1], g: g, parent: node}
+				neighbor.f = g + navDistance(key[0], key[1], search.end)
+				search.nodes[key] = neighbor
+				heap.Push(search.openList, neighbor)
+			} else if g < neighbor.g {
+				neighbor.g = g
+				neighbor.f = g + navDistance(key[0], key[1], search.end)
+				neighbor.parent = node
+				heap.Fix(search.openList, neighbor.heapIndex)
+			}
+		}
+		if budget >= 0 && search.nav.didRead {
+			break
+		}
+	}
+	return false
+}
+
+// The floor height of a world column, or navBlocked
+func (search *NavSearch) floor(worldX, worldY int) int {
+	if worldX < 0 || worldY < 0 {
+		return navBlocked
+	}
+	ns := search.nav.getSection(worldX/SECTION_SIZE, worldY/SECTION_SIZE, search.profile, search.profileKey)
+	return int(ns.floor[worldX%SECTION_SIZE][worldY%SECTION_SIZE])
+}
+
+func (search *NavSearch) isOpen(cx, cy int) bool {
+	return search.waypoint(cx, cy) != nil
+}
+
+// can we move from cell (cx, cy) to the neighboring cell (cx+dx, cy+dy)? Like the view's A*, dropping
+// down is always possible, stepping up only by the profile's MaxStep.
+func (search *NavSearch) isConnected(cx, cy, dx, dy int) bool {
+	for i := 0; i < NAV_CELL; i++ {
+		var ax, ay, bx, by int
+		if dx != 0 {
+			ax, ay = cx*NAV_CELL, cy*NAV_CELL+i
+			if dx > 0 {
+				ax += NAV_CELL - 1
+			}
+			bx, by = ax+dx, ay
+		} else {
+			ax, ay = cx*NAV_CELL+i, cy*NAV_CELL
+			if dy > 0 {
+				ay += NAV_CELL - 1
+			}
+			bx, by = ax, ay+dy
+		}
+		a := search.floor(ax, ay)
+		b := search.floor(bx, by)
+		if a != navBlocked && b != navBlocked && b-a <= search.profile.MaxStep {
+			return true
+		}
+	}
+	return false
+}
+
+// the walkable position nearest the center of a cell
+func (search *NavSearch) waypoint(cx, cy int) *[3]int {
+	var best *[3]int
+	bestD := 0
+	for x := cx * NAV_CELL; x < (cx+1)*NAV_CELL; x++ {
+		for y := cy * NAV_CELL; y < (cy+1)*NAV_CELL; y++ {
+			if z := search.floor(x, y); z != navBlocked {
+				dx := x - cx*NAV_CELL - NAV_CELL/2
+				dy := y - cy*NAV_CELL - NAV_CELL/2
+				if d := dx*dx + dy*dy; best == nil || d < bestD {
+					best = &[3]int{x, y, z}
+					bestD = d
+				}
+			}
+		}
+	}
+	return best
+}
+
+// the walkable position nearest the center of a cell that can be reached from the position from, which
+// is in the cell next to it. Falls back to the nearest one if none can be reached within the two cells.
+func (search *NavSearch) connectedWaypoint(from [3]int, cx, cy int) *[3]int {
+	fcx, fcy := from[0]/NAV_CELL, from[1]/NAV_CELL
+	minX, maxX := fcx, cx
+	if cx < fcx {
+		minX, maxX = cx, fcx
+	}
+	minY, maxY := fcy, cy
+	if cy < fcy {
+		minY, maxY = cy, fcy
+	}
+	var best *[3]int
+	bestD := 0
+	seen := map[[2]int]bool{{from[0], from[1]}: true}
+	queue := [][3]int{from}
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+		if pos[0]/NAV_CELL == cx && pos[1]/NAV_CELL == cy {
+			dx := pos[0] - cx*NAV_CELL - NAV_CELL/2
+			dy := pos[1] - cy*NAV_CELL - NAV_CELL/2
+			if d := dx*dx + dy*dy; best == nil || d < bestD {
+				waypoint := pos
+				best = &waypoint
+				bestD = d
+			}
+		}
+		for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			x, y := pos[0]+d[0], pos[1]+d[1]
+			if x < minX*NAV_CELL || x >= (maxX+1)*NAV_CELL || y < minY*NAV_CELL || y >= (maxY+1)*NAV_CELL || seen[[2]int{x, y}] {
+				continue
+			}
+			// like isConnected: drop down any height, step up by MaxStep
+			z := search.floor(x, y)
+			if z == navBlocked || z-pos[2] > search.profile.MaxStep {
+				continue
+			}
+			seen[[2]int{x, y}] = true
+			queue = append(queue, [3]int{x, y, z})
+		}
+	}
+	if best == nil {
+		return search.waypoint(cx, cy)
+	}
+	return best
+}
+
+type navNode struct {
+	cx, cy    int
+	g, f      int
+	parent    *navNode
+	closed    bool
+	heapIndex int
+}
+
+type navHeap []*navNode
+
+func (h navHeap) Len() int           { return len(h) }
+func (h navHeap) Less(i, j int) bool { return h[i].f < h[j].f }
+func (h navHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *navHeap) Push(x interface{}) {
+	node := x.(*navNode)
+	node.heapIndex = len(*h)
+	*h = append(*h, node)
+}
+
+func (h *navHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	node := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return node
+}
+
+func navDistance(cx, cy int, end [2]int) int {
+	dx := cx - end[0]
+	dy := cy - end[1]
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	return dx + dy
+}
+
+func (search *NavSearch) toWaypoints(node *navNode) [][3]int {
+	cells := []*navNode{}
+	for ; node != nil; node = node.parent {
+		cells = append(cells, node)
+	}
+	// one waypoint per cell between the start and the end, each reachable from the one before
+	ret := [][3]int{}
+	from := search.startPos
+	for i := len(cells) - 2; i > 0; i-- {
+		waypoint := search.connectedWaypoint(from, cells[i].cx, cells[i].cy)
+		ret = append(ret, *waypoint)
+		from = *waypoint
+	}
+	return append(ret, search.endPos)
+}
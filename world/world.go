@@ -10,14 +10,13 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/go-gl/glfw/v3.3/glfw"
 	"github.com/uzudil/isongn/shapes"
 )
 
 const (
 	SECTION_SIZE   = 200
 	SECTION_Z_SIZE = 24
-	VERSION        = 5
+	VERSION        = 6
 	EDITOR_MODE    = 0
 	RUNNER_MODE    = 1
 )
@@ -28,6 +27,10 @@ type SectionPosition struct {
 	// extra non blocking shapes: plants, items, etc.
 	Extras []int
 	Under  int
+	// overlay creature sheets drawn on top of Block (paper-doll layers)
+	Layers []int
+	// colour variant of Block (variant index + 1, 0 is the base shape)
+	Variant int
 }
 
 type Section struct {
@@ -64,6 +67,7 @@ type Loader struct {
 	X, Y         int
 	sectionCache *SectionCache
 	ioMode       int
+	Nav          *NavGrid
 }
 
 type WorldObserver interface {
@@ -73,7 +77,14 @@ type WorldObserver interface {
 }
 
 func NewLoader(observer WorldObserver, userDir, gameDir string) *Loader {
-	return &Loader{observer, userDir, gameDir, 5000, 5000, NewSectionCache(), EDITOR_MODE}
+	loader := &Loader{observer, userDir, gameDir, 5000, 5000, NewSectionCache(), EDITOR_MODE, nil}
+	loader.Nav = NewNavGrid(loader)
+	return loader
+}
+
+// the world position at the center of the view
+func (loader *Loader) GetCenter() (int, int) {
+	return loader.X, loader.Y
 }
 
 func (loader *Loader) SetIoMode(mode int) {
@@ -114,7 +125,9 @@ func (loader *Loader) GetEdge(x, y int) (int, bool) {
 
 func (loader *Loader) SetShape(x, y, z int, shapeIndex int) bool {
 	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	loader.shapeChanged(section, section.Pos[atomX][atomY][atomZ].Block)
 	section.Pos[atomX][atomY][atomZ].Block = shapeIndex + 1
+	loader.shapeChanged(section, shapeIndex+1)
 	return true
 }
 
@@ -122,12 +135,22 @@ func (loader *Loader) EraseShape(x, y, z int) bool {
 	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
 	shapeIndex := section.Pos[atomX][atomY][atomZ].Block
 	if shapeIndex > 0 {
+		loader.shapeChanged(section, shapeIndex)
 		section.Pos[atomX][atomY][atomZ].Block = 0
+		section.Pos[atomX][atomY][atomZ].Layers = nil
+		section.Pos[atomX][atomY][atomZ].Variant = 0
 		return true
 	}
 	return false
 }
 
+// the nav grid ignores the shapes that are not saved (creatures, etc.)
+func (loader *Loader) shapeChanged(section *Section, block int) {
+	if block > 0 && shapes.Shapes[block-1].IsSaved {
+		loader.Nav.Invalidate(section.X, section.Y)
+	}
+}
+
 func (loader *Loader) GetPos(worldX, worldY, worldZ int) *SectionPosition {
 	section, atomX, atomY, atomZ := loader.getPosInSection(worldX, worldY, worldZ)
 	return &section.Pos[atomX][atomY][atomZ]
@@ -179,6 +202,59 @@ func (loader *Loader) GetExtra(worldX, worldY, worldZ, i int) (int, bool) {
 	return 0, false
 }
 
+func (loader *Loader) AddLayer(x, y, z int, shapeIndex int) bool {
+	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	section.Pos[atomX][atomY][atomZ].Layers = append(section.Pos[atomX][atomY][atomZ].Layers, shapeIndex)
+	return true
+}
+
+func (loader *Loader) EraseLayer(x, y, z, shapeIndex int) bool {
+	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	l := section.Pos[atomX][atomY][atomZ].Layers
+	for index, currShapeIndex := range l {
+		if currShapeIndex == shapeIndex {
+			section.Pos[atomX][atomY][atomZ].Layers = append(l[:index], l[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (loader *Loader) EraseAllLayers(x, y, z int) bool {
+	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	section.Pos[atomX][atomY][atomZ].Layers = nil
+	return true
+}
+
+func (loader *Loader) SetLayers(x, y, z int, layers []int) {
+	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	section.Pos[atomX][atomY][atomZ].Layers = layers
+}
+
+func (loader *Loader) GetLayers(worldX, worldY, worldZ int) []int {
+	section, atomX, atomY, atomZ := loader.getPosInSection(worldX, worldY, worldZ)
+	return section.Pos[atomX][atomY][atomZ].Layers
+}
+
+func (loader *Loader) ClearVariant(x, y, z int) {
+	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	section.Pos[atomX][atomY][atomZ].Variant = 0
+}
+
+func (loader *Loader) SetVariant(x, y, z int, variantIndex int) {
+	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	section.Pos[atomX][atomY][atomZ].Variant = variantIndex + 1
+}
+
+func (loader *Loader) GetVariant(x, y, z int) (int, bool) {
+	section, atomX, atomY, atomZ := loader.getPosInSection(x, y, z)
+	variant := section.Pos[atomX][atomY][atomZ].Variant
+	if variant == 0 {
+		return 0, false
+	}
+	return variant - 1, true
+}
+
 func (loader *Loader) GetSectionPos() (int, int) {
 	sx := loader.X / SECTION_SIZE
 	sy := loader.Y / SECTION_SIZE
@@ -251,7 +327,7 @@ func (loader *Loader) getSection(sx, sy int) (*Section, error) {
 
 	// put in cache
 	loader.sectionCache.cache[oldestIndex] = section
-	loader.sectionCache.times[oldestIndex] = glfw.GetTime()
+	loader.sectionCache.times[oldestIndex] = float64(time.Now().UnixNano()) / 1e9
 
 	loader.observer.SectionLoad(sx, sy, section.data)
 	loader.observer.Loading(false)
@@ -270,6 +346,18 @@ func (loader *Loader) getSection(sx, sy int) (*Section, error) {
 	return section, nil
 }
 
+// ReadSection returns a section without putting it in the cache. The second return value is true
+// if the section came from the cache.
+func (loader *Loader) ReadSection(sx, sy int) (*Section, bool, error) {
+	for _, c := range loader.sectionCache.cache {
+		if c != nil && c.X == sx && c.Y == sy {
+			return c, true, nil
+		}
+	}
+	section, err := loader.load(sx, sy)
+	return section, false, err
+}
+
 func (loader *Loader) SaveAll() error {
 	for _, c := range loader.sectionCache.cache {
 		if c != nil {
@@ -344,10 +432,132 @@ func (loader *Loader) load(sx, sy int) (*Section, error) {
 			fixArrays(data)
 			section.data = data
 		}
+		if version[0] >= 6 {
+			// shape indexes are positions in the saved names table
+			var names []string
+			err = dec.Decode(&names)
+			if err != nil {
+				return nil, err
+			}
+			section.remapShapes(func(index int) (int, bool) {
+				if index >= len(names) {
+					return 0, false
+				}
+				newIndex, ok := shapes.Names[names[index]]
+				return newIndex, ok
+			}, sameNames(names))
+			// variant indexes are positions in the saved variant names table
+			var variantNames []string
+			err = dec.Decode(&variantNames)
+			if err != nil {
+				return nil, err
+			}
+			section.remapVariants(func(index int) (int, bool) {
+				if index >= len(variantNames) {
+					return 0, false
+				}
+				newIndex, ok := shapes.VariantNames[variantNames[index]]
+				return newIndex, ok
+			})
+		} else {
+			// older maps used imageIndex*0x100 + position in the image
+			section.remapShapes(func(index int) (int, bool) {
+				newIndex, ok := shapes.LegacyIndex[index]
+				return newIndex, ok
+			}, false)
+			// and stored variants in config order
+			section.remapVariants(func(index int) (int, bool) {
+				return index, index < len(shapes.Variants)
+			})
+		}
 	}
 	return section, nil
 }
 
+func sameNames(names []string) bool {
+	if len(names) != len(shapes.Shapes) {
+		return false
+	}
+	for index, name := range names {
+		if shapes.Shapes[index].Name != name {
+			return false
+		}
+	}
+	return true
+}
+
+func (section *Section) remapShapes(remap func(int) (int, bool), identity bool) {
+	if identity {
+		return
+	}
+	missing := map[int]bool{}
+	remapEncoded := func(value int) int {
+		if value == 0 {
+			return 0
+		}
+		if newIndex, ok := remap(value - 1); ok {
+			return newIndex + 1
+		}
+		missing[value-1] = true
+		return 0
+	}
+	remapList := func(list []int) []int {
+		if len(list) == 0 {
+			return list
+		}
+		r := []int{}
+		for _, index := range list {
+			if newIndex, ok := remap(index); ok {
+				r = append(r, newIndex)
+			} else {
+				missing[index] = true
+			}
+		}
+		return r
+	}
+	for x := 0; x < SECTION_SIZE; x++ {
+		for y := 0; y < SECTION_SIZE; y++ {
+			for z := 0; z < SECTION_Z_SIZE; z++ {
+				pos := &section.Pos[x][y][z]
+				pos.Block = remapEncoded(pos.Block)
+				pos.Edge = remapEncoded(pos.Edge)
+				pos.Under = remapEncoded(pos.Under)
+				pos.Extras = remapList(pos.Extras)
+				pos.Layers = remapList(pos.Layers)
+				if pos.Block == 0 {
+					pos.Variant = 0
+				}
+			}
+		}
+	}
+	for index := range missing {
+		fmt.Printf("\tMissing shape %d in map %d,%d: removed\n", index, section.X, section.Y)
+	}
+}
+
+func (section *Section) remapVariants(remap func(int) (int, bool)) {
+	missing := map[int]bool{}
+	for x := 0; x < SECTION_SIZE; x++ {
+		for y := 0; y < SECTION_SIZE; y++ {
+			for z := 0; z < SECTION_Z_SIZE; z++ {
+				pos := &section.Pos[x][y][z]
+				if pos.Variant == 0 {
+					continue
+				}
+				if newIndex, ok := remap(pos.Variant - 1); ok {
+					pos.Variant = newIndex + 1
+				} else {
+					missing[pos.Variant-1] = true
+					pos.Variant = 0
+				}
+			}
+		}
+	}
+	for index := range missing {
+		fmt.Printf("\tMissing variant %d in map %d,%d: removed\n", index, section.X, section.Y)
+	}
+}
+
 func (section *Section) calculateUnder() {
 	// configure Under[]
 	for x := 0; x < SECTION_SIZE; x++ {
@@ -375,6 +585,8 @@ func (section *Section) removeTransient() {
 				if block > 0 && shapes.Shapes[block-1].IsSaved == false {
 					fmt.Printf("\tNOT SAVING %s\n", shapes.Shapes[block-1].Name)
 					section.Pos[x][y][z].Block = 0
+					section.Pos[x][y][z].Layers = nil
+					section.Pos[x][y][z].Variant = 0
 				}
 			}
 		}
@@ -412,6 +624,8 @@ func (loader *Loader) save(section *Section) error {
 		section.calculateUnder()
 	}
 
+	loader.Nav.Invalidate(section.X, section.Y)
+
 	enc := gob.NewEncoder(fz)
 	err = enc.Encode(section.Pos)
 	if err != nil {
@@ -425,6 +639,22 @@ func (loader *Loader) save(section *Section) error {
 	if err != nil {
 		return err
 	}
+	names := make([]string, len(shapes.Shapes))
+	for index, shape := range shapes.Shapes {
+		names[index] = shape.Name
+	}
+	err = enc.Encode(names)
+	if err != nil {
+		return err
+	}
+	variantNames := make([]string, len(shapes.Variants))
+	for index, variant := range shapes.Variants {
+		variantNames[index] = variant.Name
+	}
+	err = enc.Encode(variantNames)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
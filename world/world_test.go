@@ -0,0 +1,290 @@
+package world
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uzudil/isongn/shapes"
+)
+
+type testObserver struct{}
+
+func (observer *testObserver) SectionLoad(x, y int, data map[string]interface{}) {}
+
+func (observer *testObserver) SectionSave(x, y int) map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (observer *testObserver) Loading(working bool) {}
+
+// replace the shape table with shapes of the given names, in that order
+func setTestShapes(names ...string) {
+	shapes.Shapes = []*shapes.Shape{}
+	shapes.Names = map[string]int{}
+	for index, name := range names {
+		shapes.Shapes = append(shapes.Shapes, &shapes.Shape{Index: index, Name: name, IsSaved: true})
+		shapes.Names[name] = index
+	}
+}
+
+// replace the variant table with variants of the given names, in that order
+func setTestVariants(names ...string) {
+	shapes.Variants = []*shapes.Variant{}
+	shapes.VariantNames = map[string]int{}
+	for index, name := range names {
+		shapes.Variants = append(shapes.Variants, &shapes.Variant{Name: name})
+		shapes.VariantNames[name] = index
+	}
+}
+
+func newTestLoader(t *testing.T) *Loader {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "maps"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	return NewLoader(&testObserver{}, dir, dir)
+}
+
+func shapeName(encoded int) string {
+	if encoded == 0 {
+		return ""
+	}
+	return shapes.Shapes[encoded-1].Name
+}
+
+func TestLoadWithReorderedShapes(t *testing.T) {
+	setTestShapes("grass", "wall", "tree", "hat")
+	loader := newTestLoader(t)
+	section := &Section{X: 1, Y: 2, data: map[string]interface{}{}}
+	pos := &section.Pos[10][20][3]
+	pos.Block = shapes.Names["wall"] + 1
+	pos.Edge = shapes.Names["grass"] + 1
+	pos.Extras = []int{shapes.Names["tree"]}
+	pos.Layers = []int{shapes.Names["hat"]}
+	if err := loader.save(section); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config changed: shapes were reordered and one was inserted
+	setTestShapes("hat", "rock", "tree", "wall", "grass")
+	loaded, err := loader.load(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := loaded.Pos[10][20][3]
+	if shapeName(got.Block) != "wall" || shapeName(got.Edge) != "grass" {
+		t.Errorf("expected wall on grass, got %q on %q", shapeName(got.Block), shapeName(got.Edge))
+	}
+	if len(got.Extras) != 1 || shapes.Shapes[got.Extras[0]].Name != "tree" {
+		t.Errorf("expected a tree extra, got %v", got.Extras)
+	}
+	if len(got.Layers) != 1 || shapes.Shapes[got.Layers[0]].Name != "hat" {
+		t.Errorf("expected a hat layer, got %v", got.Layers)
+	}
+}
+
+func TestLoadWithReorderedVariants(t *testing.T) {
+	setTestShapes("wall")
+	setTestVariants("red", "green", "blue")
+	loader := newTestLoader(t)
+	section := &Section{X: 0, Y: 0, data: map[string]interface{}{}}
+	section.Pos[1][1][0].Block = shapes.Names["wall"] + 1
+	section.Pos[1][1][0].Variant = shapes.VariantNames["blue"] + 1
+	section.Pos[2][2][0].Block = shapes.Names["wall"] + 1
+	section.Pos[2][2][0].Variant = shapes.VariantNames["red"] + 1
+	if err := loader.save(section); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config changed: variants were reordered and red was removed
+	setTestVariants("blue", "green")
+	loaded, err := loader.load(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variant := loaded.Pos[1][1][0].Variant; variant != shapes.VariantNames["blue"]+1 {
+		t.Errorf("expected the blue variant, got %d", variant)
+	}
+	if variant := loaded.Pos[2][2][0].Variant; variant != 0 {
+		t.Errorf("expected the missing variant to be removed, got %d", variant)
+	}
+}
+
+func TestLoadRemovesMissingShapes(t *testing.T) {
+	setTestShapes("grass", "wall")
+	loader := newTestLoader(t)
+	section := &Section{X: 0, Y: 0, data: map[string]interface{}{}}
+	section.Pos[1][1][0].Block = shapes.Names["wall"] + 1
+	section.Pos[1][1][0].Variant = 2
+	if err := loader.save(section); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestShapes("grass")
+	loaded, err := loader.load(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Pos[1][1][0]; got.Block != 0 || got.Variant != 0 {
+		t.Errorf("expected the missing shape to be removed, got %+v", got)
+	}
+}
+
+func TestLoadVersion5(t *testing.T) {
+	setTestShapes("grass", "wall", "tree")
+	// in version 5 maps a shape is imageIndex*0x100 + its position in the image
+	shapes.LegacyIndex = map[int]int{0x000: 0, 0x100: 1, 0x101: 2}
+	loader := newTestLoader(t)
+
+	section := &Section{}
+	section.Pos[5][6][0].Edge = 0x000 + 1
+	section.Pos[5][6][1].Block = 0x100 + 1
+	section.Pos[5][6][1].Extras = []int{0x101}
+	// not in the legacy table
+	section.Pos[7][7][0].Block = 0x205 + 1
+	writeVersion5(t, filepath.Join(loader.gameDir, "maps", mapFileName(3, 4)), section, map[string]interface{}{"visited": true})
+
+	loaded, err := loader.load(3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := shapeName(loaded.Pos[5][6][0].Edge); name != "grass" {
+		t.Errorf("expected a grass edge, got %q", name)
+	}
+	if name := shapeName(loaded.Pos[5][6][1].Block); name != "wall" {
+		t.Errorf("expected a wall, got %q", name)
+	}
+	if extras := loaded.Pos[5][6][1].Extras; len(extras) != 1 || shapes.Shapes[extras[0]].Name != "tree" {
+		t.Errorf("expected a tree extra, got %v", extras)
+	}
+	if block := loaded.Pos[7][7][0].Block; block != 0 {
+		t.Errorf("expected the unknown shape to be removed, got %d", block)
+	}
+	if loaded.data["visited"] != true {
+		t.Errorf("expected the section data to load, got %v", loaded.data)
+	}
+}
+
+func writeVersion5(t *testing.T, path string, section *Section, data map[string]interface{}) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fz := gzip.NewWriter(f)
+	defer fz.Close()
+	fz.Write([]byte{5})
+	enc := gob.NewEncoder(fz)
+	if err := enc.Encode(section.Pos); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(bytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a 64x64 area of ground in section 0,0
+func newNavTestLoader(t *testing.T) *Loader {
+	setTestShapes("ground", "water", "wall")
+	shapes.Shapes[0].Size = [3]float32{1, 1, 1}
+	shapes.Shapes[1].Size = [3]float32{1, 1, 1}
+	shapes.Shapes[1].NoSupport = true
+	shapes.Shapes[2].Size = [3]float32{1, 1, 8}
+	loader := newTestLoader(t)
+	loader.MoveTo(32, 32)
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			loader.SetShape(x, y, 0, shapes.Names["ground"])
+		}
+	}
+	return loader
+}
+
+func TestNavProfile(t *testing.T) {
+	loader := newNavTestLoader(t)
+	for x := 32; x < 40; x++ {
+		for y := 0; y < 64; y++ {
+			loader.SetShape(x, y, 0, shapes.Names["water"])
+		}
+	}
+	if waypoints := loader.Nav.FindPath(4, 4, 60, 4, &NavProfile{MaxStep: 1}); waypoints != nil {
+		t.Errorf("expected no walking path across the water, got %v", waypoints)
+	}
+	waypoints := loader.Nav.FindPath(4, 4, 60, 4, &NavProfile{IsFlying: true, MaxStep: 1})
+	if len(waypoints) == 0 || waypoints[len(waypoints)-1] != [3]int{60, 4, 1} {
+		t.Errorf("expected a flying path ending at 60,4,1, got %v", waypoints)
+	}
+}
+
+func TestNavEdit(t *testing.T) {
+	loader := newNavTestLoader(t)
+	for y := 0; y < 64; y++ {
+		loader.SetShape(32, y, 1, shapes.Names["wall"])
+	}
+	profile := &NavProfile{MaxStep: 1}
+	if waypoints := loader.Nav.FindPath(4, 4, 60, 4, profile); waypoints != nil {
+		t.Errorf("expected no path across the wall, got %v", waypoints)
+	}
+	if waypoints := loader.Nav.FindPath(4, 4, 60, 4, &NavProfile{MaxStep: 8}); waypoints == nil {
+		t.Errorf("expected to step over the wall")
+	}
+	loader.EraseShape(32, 40, 1)
+	if waypoints := loader.Nav.FindPath(4, 4, 60, 4, profile); waypoints == nil {
+		t.Errorf("expected a path through the gap in the wall")
+	}
+}
+
+func TestNavSectionBorder(t *testing.T) {
+	setTestShapes("ground", "wall")
+	shapes.Shapes[0].Size = [3]float32{1, 1, 1}
+	// too tall to stand on
+	shapes.Shapes[1].Size = [3]float32{1, 4, SECTION_Z_SIZE - 1}
+	loader := newTestLoader(t)
+	loader.MoveTo(100, 200)
+	for x := 80; x < 120; x++ {
+		for y := 150; y < 250; y++ {
+			loader.SetShape(x, y, 0, shapes.Names["ground"])
+		}
+	}
+	// a wall on a coarse cell border, the piece at y=198 reaches into the next section
+	for y := 150; y < 250; y += 4 {
+		loader.SetShape(13*NAV_CELL, y, 1, shapes.Names["wall"])
+	}
+	if waypoints := loader.Nav.FindPath(90, 200, 110, 200, &NavProfile{MaxStep: 1}); waypoints != nil {
+		t.Errorf("expected no path across the wall, got %v", waypoints)
+	}
+}
+
+func TestNavWaypointConnected(t *testing.T) {
+	loader := newNavTestLoader(t)
+	// a single row of cells
+	for x := 0; x < 64; x++ {
+		for y := NAV_CELL; y < 64; y++ {
+			loader.SetShape(x, y, 0, shapes.Names["water"])
+		}
+	}
+	// a platform that can't be climbed, covering the middle of the third cell
+	for x := 2*NAV_CELL + 1; x < 3*NAV_CELL; x++ {
+		for y := 1; y < NAV_CELL; y++ {
+			loader.SetShape(x, y, 1, shapes.Names["wall"])
+		}
+	}
+	waypoints := loader.Nav.FindPath(4, 4, 40, 4, &NavProfile{MaxStep: 1})
+	if waypoints == nil {
+		t.Fatal("expected a path around the platform")
+	}
+	for _, waypoint := range waypoints {
+		if waypoint[2] != 1 {
+			t.Errorf("expected every waypoint on the ground, got %v", waypoints)
+			break
+		}
+	}
+}